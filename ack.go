@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ackCallback is an acknowledgement of a highest priority notification, as
+// posted by pushover to the callback url.
+type ackCallback struct {
+	Receipt              string
+	AcknowledgedAt       time.Time
+	AcknowledgedBy       string
+	AcknowledgedByDevice string
+}
+
+// ackListener is an http server receiving acknowledgement callbacks.
+type ackListener struct {
+	srv  *http.Server
+	acks chan ackCallback
+}
+
+// listenAck starts an http server on addr for acknowledgement callbacks. Any
+// path is accepted.
+func listenAck(addr string) (*ackListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &ackListener{acks: make(chan ackCallback, 16)}
+	l.srv = &http.Server{
+		Handler:           http.HandlerFunc(l.serve),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := l.srv.Serve(ln); err != http.ErrServerClosed {
+			log.Printf("serving acknowledgement listener: %s", err)
+		}
+	}()
+	return l, nil
+}
+
+func (l *ackListener) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "405 - method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "400 - bad request - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	receipt := r.PostForm.Get("receipt")
+	if receipt == "" || r.PostForm.Get("acknowledged") != "1" {
+		http.Error(w, "400 - bad request - missing receipt or acknowledgement", http.StatusBadRequest)
+		return
+	}
+	t, _ := strconv.ParseInt(r.PostForm.Get("acknowledged_at"), 10, 64)
+	ack := ackCallback{receipt, time.Unix(t, 0), r.PostForm.Get("acknowledged_by"), r.PostForm.Get("acknowledged_by_device")}
+	select {
+	case l.acks <- ack:
+	default:
+		log.Printf("dropping acknowledgement callback for receipt %s, too many pending", receipt)
+	}
+}
+
+// wait prints acknowledgements for receipts to out as they come in, until all
+// are acknowledged or ctx is done. Callbacks for other receipts are ignored.
+func (l *ackListener) wait(ctx context.Context, receipts []string, out io.Writer) error {
+	pending := map[string]bool{}
+	for _, r := range receipts {
+		pending[r] = true
+	}
+	for len(pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for acknowledgement of %d notification(s): %w", len(pending), ctx.Err())
+		case ack := <-l.acks:
+			if !pending[ack.Receipt] {
+				log.Printf("ignoring acknowledgement callback for unknown receipt %s", ack.Receipt)
+				continue
+			}
+			delete(pending, ack.Receipt)
+			fmt.Fprintf(out, "receipt %s: acknowledged at %s by %s (device %s)\n", ack.Receipt, formatTime(ack.AcknowledgedAt), ack.AcknowledgedBy, ack.AcknowledgedByDevice)
+		}
+	}
+	return nil
+}
+
+// close shuts down the listener.
+func (l *ackListener) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.srv.Shutdown(ctx); err != nil {
+		log.Printf("shutting down acknowledgement listener: %s", err)
+	}
+}
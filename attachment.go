@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"slices"
+)
+
+// Maximum size of an attachment, in bytes.
+const maxAttachmentSize = 5 * 1024 * 1024
+
+// attachment is an image sent with a message.
+type attachment struct {
+	Data []byte
+	Type string // Mime type, e.g. image/png.
+}
+
+// Maximum size of an image read for resizing with -attachment-resize.
+const maxResizeInputSize = 100 * 1024 * 1024
+
+// readAttachment reads an attachment from r, failing if it is larger than the
+// maximum size without reading further. If resize is set, images larger than
+// the maximum size are scaled down to fit, and sent as JPEG.
+func readAttachment(r io.Reader, mimeType string, resize bool) (*attachment, error) {
+	limit := int64(maxAttachmentSize)
+	if resize {
+		limit = maxResizeInputSize
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > limit {
+		return nil, fmt.Errorf("attachment larger than maximum of %d bytes", limit)
+	}
+	if len(buf) > maxAttachmentSize {
+		return resizeImage(buf)
+	}
+	return &attachment{buf, mimeType}, nil
+}
+
+// resizeImage decodes the image in buf, and scales it down, keeping the aspect
+// ratio, until it fits in the maximum attachment size when encoded as JPEG.
+func resizeImage(buf []byte) (*attachment, error) {
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image for resizing: %w", err)
+	}
+	b := img.Bounds()
+	// Start with a guess based on the ratio of sizes, and shrink further as needed.
+	scale := math.Sqrt(float64(maxAttachmentSize) / float64(len(buf)))
+	for {
+		w := max(1, int(float64(b.Dx())*scale))
+		h := max(1, int(float64(b.Dy())*scale))
+		var out bytes.Buffer
+		if err := jpeg.Encode(&out, scaleImage(img, w, h), &jpeg.Options{Quality: 85}); err != nil {
+			return nil, fmt.Errorf("encoding resized image: %w", err)
+		}
+		if out.Len() <= maxAttachmentSize {
+			log.Printf("resized attachment from %dx%d to %dx%d, %d bytes", b.Dx(), b.Dy(), w, h, out.Len())
+			return &attachment{out.Bytes(), "image/jpeg"}, nil
+		}
+		scale *= 0.8
+	}
+}
+
+// scaleImage returns img scaled down to w by h pixels, with each pixel the
+// average of the pixels it covers in img.
+func scaleImage(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := range w {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// multipartForm returns a multipart/form-data body with data and the
+// attachment, and the content-type including boundary.
+func multipartForm(data url.Values, att *attachment) ([]byte, string, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, k := range slices.Sorted(maps.Keys(data)) {
+		for _, v := range data[k] {
+			if err := mw.WriteField(k, v); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="attachment"; filename="attachment"`)
+	h.Set("Content-Type", att.Type)
+	w, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(att.Data); err != nil {
+		return nil, "", err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return b.Bytes(), mw.FormDataContentType(), nil
+}
+
+// progressReader reads from r, calling fn with the total number of bytes read
+// so far after each read. Reads fail once ctx is done.
+type progressReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   int64
+	fn  func(n int64)
+}
+
+func (r *progressReader) Read(buf []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(buf)
+	if n > 0 {
+		r.n += int64(n)
+		r.fn(r.n)
+	}
+	return n, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// batchLines reads lines from r until end of file, calling send for each
+// non-empty line. Without coalesce, interval is the minimum time between calls
+// to send. With coalesce, lines read within interval after the first pending
+// line are joined into a single message, as long as it fits in the maximum
+// message length.
+func batchLines(r io.Reader, interval time.Duration, coalesce bool, send func(msg string)) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("reading stdin: %s", err)
+		}
+	}()
+
+	var last time.Time
+	var pending []string
+	var pendingLen int
+	var timer <-chan time.Time
+	flush := func() {
+		if len(pending) > 0 {
+			send(strings.Join(pending, "\n"))
+		}
+		pending = nil
+		pendingLen = 0
+		timer = nil
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if !coalesce {
+				time.Sleep(interval - time.Since(last))
+				send(line)
+				last = time.Now()
+				continue
+			}
+			n := utf8.RuneCountInString(line)
+			if len(pending) > 0 && pendingLen+1+n > maxMessageLength {
+				flush()
+			}
+			if len(pending) > 0 {
+				pendingLen++
+			}
+			pending = append(pending, line)
+			pendingLen += n
+			if timer == nil {
+				timer = time.After(interval)
+			}
+		case <-timer:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mjl-/sconf"
+)
+
+// parseConfigURL fetches the config file from u and parses it into config. A
+// successfully parsed config file is stored in a cache file in stateDir, if set.
+// If fetching fails and a cached copy exists, it is used instead, with a warning.
+func parseConfigURL(u string, timeout time.Duration, stateDir string) error {
+	var cachePath string
+	if stateDir != "" {
+		h := sha256.Sum256([]byte(u))
+		cachePath = filepath.Join(stateDir, "config-"+hex.EncodeToString(h[:8])+".conf")
+	}
+
+	buf, err := fetchConfig(u, timeout)
+	if err == nil {
+		if err := sconf.Parse(bytes.NewReader(buf), &config); err != nil {
+			return fmt.Errorf("parsing config file from %s: %w", u, err)
+		}
+		if cachePath != "" {
+			if err := writeFile(cachePath, buf); err != nil {
+				log.Printf("warning: storing cached copy of config file: %s", err)
+			}
+		}
+		return nil
+	}
+	if cachePath == "" {
+		return err
+	}
+	if _, serr := os.Stat(cachePath); serr != nil {
+		return err
+	}
+	log.Printf("warning: fetching config file: %s; using cached copy %s", err, cachePath)
+	return sconf.ParseFile(cachePath, &config)
+}
+
+// fetchConfig fetches the config file at u.
+func fetchConfig(u string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching config file from %s: got status %q, expected 200 ok", u, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
+
+// writeFile writes buf to path atomically, creating the directory if needed.
+func writeFile(path string, buf []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cooldownState holds the time of the last successful send per key, persisted
+// in a file with a line per key.
+type cooldownState struct {
+	path string
+	last map[string]time.Time
+}
+
+// loadCooldown reads the state from path. A missing file results in empty
+// state.
+func loadCooldown(path string) (*cooldownState, error) {
+	c := &cooldownState{path, map[string]time.Time{}}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		if line == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(line, " ")
+		t, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad line %q", line)
+		}
+		c.last[k] = time.Unix(t, 0)
+	}
+	return c, nil
+}
+
+// cooldownKey returns the key under which sends to user with title are recorded.
+func cooldownKey(user, title string) string {
+	h := sha256.Sum256([]byte(user + "\n" + title))
+	return hex.EncodeToString(h[:16])
+}
+
+// active returns the time of the last send for key, and whether it was within d.
+func (c *cooldownState) active(key string, d time.Duration) (time.Time, bool) {
+	t, ok := c.last[key]
+	return t, ok && time.Since(t) < d
+}
+
+// record stores t as the time of the last send for key, and saves the state.
+func (c *cooldownState) record(key string, t time.Time) error {
+	c.last[key] = t
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(c.last)) {
+		fmt.Fprintf(&b, "%s %d\n", k, c.last[k].Unix())
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// dedupCache holds hashes of recently sent messages, most recently used last,
+// bounded in size, persisted in a file.
+type dedupCache struct {
+	path   string
+	size   int
+	hashes []string
+}
+
+// loadDedupCache reads the cache from path. A missing file results in an
+// empty cache.
+func loadDedupCache(path string, size int) (*dedupCache, error) {
+	c := &dedupCache{path: path, size: size}
+	buf, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	c.hashes = strings.Fields(string(buf))
+	return c, nil
+}
+
+// seen returns whether h is in the cache, marking it as most recently used.
+func (c *dedupCache) seen(h string) bool {
+	i := slices.Index(c.hashes, h)
+	if i < 0 {
+		return false
+	}
+	c.hashes = append(slices.Delete(c.hashes, i, i+1), h)
+	return true
+}
+
+// add adds h as most recently used, evicting the least recently used hashes if
+// the cache is full.
+func (c *dedupCache) add(h string) {
+	if c.seen(h) {
+		return
+	}
+	c.hashes = append(c.hashes, h)
+	if n := len(c.hashes) - c.size; n > 0 {
+		c.hashes = c.hashes[n:]
+	}
+}
+
+// save writes the cache to its file, atomically.
+func (c *dedupCache) save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, h := range c.hashes {
+		b.WriteString(h + "\n")
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// messageHash returns a hash of the form data of a message, identifying
+// identical messages. The correlation id is left out, it differs for each
+// invocation with -correlation-id auto. A timestamp from -prefix-timestamp is
+// part of the message, and is included.
+func messageHash(data url.Values) string {
+	data = maps.Clone(data)
+	data.Del("correlation_id")
+	h := sha256.Sum256([]byte(data.Encode()))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// execMessage runs the command in args and returns its stdout as message, for
+// -exec. If the command fails, its exit status and stderr are added. An error
+// is only returned if the command could not be started.
+func execMessage(args []string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", err
+	}
+	msg := strings.TrimRight(stdout.String(), "\n")
+	if exitErr != nil {
+		if msg != "" {
+			msg += "\n\n"
+		}
+		msg += fmt.Sprintf("command failed: %s", exitErr)
+		if s := strings.TrimRight(stderr.String(), "\n"); s != "" {
+			msg += "\nstderr:\n" + s
+		}
+	}
+	if msg == "" {
+		msg = "(no output)"
+	}
+	return msg, nil
+}
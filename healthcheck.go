@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// limitsResult is the response to fetching the message limits of an application.
+type limitsResult struct {
+	Status    int    `json:"status"`
+	Limit     int    `json:"limit"`
+	Remaining int    `json:"remaining"`
+	Reset     int64  `json:"reset"`
+	Request   string `json:"request"`
+}
+
+// checkConnectivity checks that the api can be reached, i.e. a connection can be
+// made and an http response is returned, regardless of status.
+func checkConnectivity(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, apiBase, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// healthcheck checks connectivity to the api, validity of the app token and
+// user key, and the remaining message quota, printing a PASS or FAIL line for
+// each check. It returns whether all checks passed.
+func healthcheck(ctx context.Context, token, user string) bool {
+	ok := true
+	report := func(check string, err error, details string) {
+		if err != nil {
+			ok = false
+			fmt.Printf("FAIL %s: %s\n", check, err)
+		} else {
+			fmt.Printf("PASS %s%s\n", check, details)
+		}
+	}
+
+	err := checkConnectivity(ctx)
+	report("connectivity", err, "")
+	if err != nil {
+		return false
+	}
+
+	vdata := url.Values{}
+	vdata.Set("token", token)
+	vdata.Set("user", user)
+	var vresult validateResult
+	err = apiPost(ctx, "users/validate.json", vdata, &vresult)
+	report("app token and user key", err, ": "+vresult.describe())
+
+	var lresult limitsResult
+	err = apiGet(ctx, "apps/limits.json", url.Values{"token": {token}}, &lresult)
+	reset := formatTime(time.Unix(lresult.Reset, 0))
+	if err == nil && lresult.Remaining <= 0 {
+		err = fmt.Errorf("message quota exhausted, 0 of %d remaining, resets at %s", lresult.Limit, reset)
+	}
+	report("message quota", err, fmt.Sprintf(": %d of %d remaining, resets at %s", lresult.Remaining, lresult.Limit, reset))
+
+	return ok
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// listenRequest is a message posted to the -listen endpoint. Only Message is
+// required, other fields override the flags and config file.
+type listenRequest struct {
+	Message  string `json:"message"`
+	Title    string `json:"title"`
+	Priority string `json:"priority"` // Name or -2 to 2.
+	User     string `json:"user"`     // User or group key, or @alias.
+	Device   string `json:"device"`
+	Sound    string `json:"sound"`
+	URL      string `json:"url"`
+	URLTitle string `json:"url_title"`
+}
+
+// listenResponse is the response to a posted message.
+type listenResponse struct {
+	Request string `json:"request,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"` // Due to -dedup or -cooldown.
+	Error   string `json:"error,omitempty"`
+}
+
+// defaultListenInterval is the minimum time between messages sent for -listen,
+// if -interval is not set, so a misbehaving local process cannot use up the
+// message quota at once.
+const defaultListenInterval = time.Second
+
+// serveMessages runs an http server on addr for -listen, calling handle for
+// each message posted as json, with content-type application/json. Requests
+// with an Origin header, i.e. from browsers, are rejected. Messages are handled
+// one at a time, at most one per interval. It returns after SIGINT or SIGTERM,
+// when pending requests are done.
+func serveMessages(addr string, interval time.Duration, handle func(listenRequest) (listenResponse, int)) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening for messages on %s", ln.Addr())
+
+	var mu sync.Mutex
+	var last time.Time
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", func(w http.ResponseWriter, r *http.Request) {
+		// Binding to localhost does not keep out web pages in a browser on this
+		// machine, e.g. with cross-origin "simple" requests, or DNS rebinding. Browsers
+		// send an Origin header with POST requests, and cannot send json cross-origin
+		// without a preflight request, which we don't allow.
+		if r.Header.Get("Origin") != "" {
+			http.Error(w, "403 - forbidden - requests from browsers are not allowed", http.StatusForbidden)
+			return
+		}
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+			http.Error(w, "415 - unsupported media type - content-type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req listenRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "400 - bad request - parsing json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Message == "" {
+			http.Error(w, "400 - bad request - missing message", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if d := interval - time.Since(last); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		last = time.Now()
+		resp, status := handle(req)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("shutting down")
+	sctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return srv.Shutdown(sctx)
+}
@@ -1,40 +1,631 @@
 // Command pushover is a simple cli tool to send pushover notifications.
 //
 // Run with -printconfig to see an example config file.
-// Use -configpath to override the default /etc/pushover.conf.
+// Use -configpath to override the default /etc/pushover.conf. The config file can
+// also be fetched from an https url, for centrally managed configuration.
 //
 // Example:
 //
 //	pushover -priority high -title 'Bad stuff' 'This is the message. There has been an unfortunate incident.'
+//
+// Multiple messages can be sent in one invocation, each in its own api call:
+//
+//	pushover -message 'Disk full' -message 'Backup failed'
+//
+// Send to multiple recipients, each in its own api call, with -user repeated:
+//
+//	pushover -user @alice -user @bob 'Deploy finished'
+//
+// Use -- before a message that starts with a dash, to prevent it from being
+// parsed as flag:
+//
+//	pushover -- -5 degrees outside
+//
+// Send a success or failure notification for a command that already ran:
+//
+//	make; pushover -exit-code $? 'make in ~/src/project'
+//
+// The exit status is 0 on success, 1 if sending failed, 2 for usage errors, and
+// 3 if the api rejected the app token as invalid.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	"maps"
+	"mime"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/signal"
+	osuser "os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mjl-/sconf"
 )
 
 var config struct {
-	AppToken string `sconf-doc:"Token identifying the sending application."`
-	DestKey  string `sconf-doc:"Key selecting the destination user or group."`
-	Title    string `sconf:"optional" sconf-doc:"Title to show with message, instead of application name."`
+	AppToken     string            `sconf-doc:"Token identifying the sending application."`
+	DestKey      string            `sconf-doc:"Key selecting the destination user or group."`
+	Device       string            `sconf:"optional" sconf-doc:"Device of DestKey to send to, instead of all devices of the user. Not used with -user, overridden by -device."`
+	Title        string            `sconf:"optional" sconf-doc:"Title to show with message, instead of application name."`
+	Priority     string            `sconf:"optional" sconf-doc:"Default priority when not specified on the command-line: lowest, low, normal, high, highest, or -2 to 2."`
+	HTML         bool              `sconf:"optional" sconf-doc:"Send messages as HTML, with tags like <b>, <i>, <u>, <font color=\"...\"> and <a href=\"...\">."`
+	Aliases      map[string]string `sconf:"optional" sconf-doc:"Friendly names for destinations, for use with -user @name. Values are a user or group key, optionally followed by a colon and a device name, e.g. USERKEY:iphone."`
+	LoudSound    string            `sconf:"optional" sconf-doc:"Sound for messages at or above the priority of -loud-above. Default siren."`
+	QuietSound   string            `sconf:"optional" sconf-doc:"Sound for messages below the priority of -loud-above. Default none, for no sound."`
+	Retry        int               `sconf:"optional" sconf-doc:"Default interval in seconds between resends of highest priority notifications, when not specified on the command-line. At least 30. Default 300."`
+	Expire       int               `sconf:"optional" sconf-doc:"Default interval in seconds after which highest priority notifications aren't retried anymore, when not specified on the command-line. At most 10800. Default 3600."`
+	MessagesPath string            `sconf:"optional" sconf-doc:"Path of the endpoint for sending messages, relative to the api base url, e.g. for relays that mount it elsewhere. Other endpoints keep their default paths. Default messages.json."`
+}
+
+// https://pushover.net/api
+// Can be changed with -api-base, e.g. for a relay.
+var apiBase = "https://api.pushover.net/1/"
+
+// messagesPath is the path of the messages endpoint, relative to apiBase. Can
+// be changed with MessagesPath in the config file or -messages-path.
+var messagesPath = "messages.json"
+
+// strictJSON is set with -strict-json, to fail on unknown fields in api
+// responses, e.g. for noticing api changes.
+var strictJSON bool
+
+// jsonBody is set with -content-type json, for sending api calls with a json
+// body instead of as form, e.g. for relays that expect json.
+var jsonBody bool
+
+// features lists capabilities printed with -features, for scripts to check if
+// this build supports them. Add to it when adding a feature.
+var features = []string{
+	"attachment",
+	"html",
+	"monospace",
+	"emergency",
+	"receipts",
+	"ack-callback",
+	"tags",
+	"cancel-by-tag",
+	"multiple-recipients",
+	"aliases",
+	"batch",
+	"listen",
+	"dedup",
+	"cooldown",
+	"healthcheck",
+	"metrics",
+	"json-body",
+	"templates",
 }
 
+// Limits on messages, in characters and seconds.
+const (
+	maxMessageLength = 1024
+	maxTitleLength   = 250
+	minRetry         = 30
+	maxExpire        = 10800
+)
+
 func xcheckf(err error, format string, args ...any) {
 	if err != nil {
 		log.Fatalf("%s: %s", fmt.Sprintf(format, args...), err)
 	}
 }
 
+// parsePriority parses a priority by name or number, returning the numeric
+// priority as used in the pushover api.
+func parsePriority(s string) (int, error) {
+	switch s {
+	case "lowest", "-2":
+		return -2, nil
+	case "low", "-1":
+		return -1, nil
+	case "", "normal", "0":
+		return 0, nil
+	case "high", "1":
+		return 1, nil
+	case "highest", "2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("invalid priority value %q", s)
+}
+
+// httpClient is used for all api calls.
+var httpClient = http.DefaultClient
+
+// If set, response headers of api calls are printed to stderr.
+var dumpHeaders bool
+
+// If set, progress of uploading attachments is printed to stderr.
+var uploadProgress bool
+
+// newTransport returns a transport for api calls, only using HTTP/1.1 if http1
+// is set, and closing connections after being idle for idleTimeout.
+func newTransport(http1 bool, idleTimeout time.Duration) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.IdleConnTimeout = idleTimeout
+	if http1 {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+// Exit status when the api rejects the app token.
+const exitInvalidToken = 3
+
+// errParseResponse is returned for 200 responses from the api that cannot be
+// parsed.
+var errParseResponse = errors.New("parsing api response")
+
+// apiError is returned for non-200 responses from the api.
+type apiError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte
+}
+
+// invalidToken returns whether the api response indicates the app token is
+// invalid.
+func (e *apiError) invalidToken() bool {
+	var resp struct {
+		Token  string   `json:"token"`
+		Errors []string `json:"errors"`
+	}
+	if json.Unmarshal(e.Body, &resp) != nil {
+		return false
+	}
+	return resp.Token == "invalid" || slices.Contains(resp.Errors, "application token is invalid")
+}
+
+func (e *apiError) Error() string {
+	// Pushover may return an html page for maintenance or outages, which isn't
+	// useful to print.
+	if ct, _, _ := mime.ParseMediaType(e.Header.Get("Content-Type")); e.StatusCode >= 500 && ct == "text/html" {
+		return fmt.Sprintf("pushover appears to be down (HTTP %d)", e.StatusCode)
+	}
+	return fmt.Sprintf("got status %q, expected 200 ok, body %q", e.Status, e.Body)
+}
+
+// messageResult is the response to sending a message.
+type messageResult struct {
+	Status    int    `json:"status"`
+	Request   string `json:"request"`
+	Receipt   string `json:"receipt"` // For highest priority.
+	Remaining int    `json:"-"`       // Remaining message quota, -1 if unknown.
+}
+
+// validateResult is the response to validating a user or group key.
+type validateResult struct {
+	Status   int      `json:"status"`
+	Group    int      `json:"group"`
+	Devices  []string `json:"devices"`
+	Licenses []string `json:"licenses"`
+	Request  string   `json:"request"`
+}
+
+// describe classifies the validated key as user or group key. The api marks
+// groups with field group, only users have devices.
+func (r validateResult) describe() string {
+	switch {
+	case r.Group == 1:
+		return "this appears to be a group key"
+	case len(r.Devices) == 1:
+		return "this is a user key with 1 device"
+	case len(r.Devices) > 0:
+		return fmt.Sprintf("this is a user key with %d devices", len(r.Devices))
+	}
+	return "this is a user key without active devices"
+}
+
+// retryPolicy specifies when sending a message is retried.
+type retryPolicy struct {
+	// Number of additional attempts for failures that are retryable.
+	Retries int
+
+	// If the message quota is exhausted, and resets before the deadline, wait
+	// and try once more.
+	RateLimit bool
+
+	// Also retry client errors other than rate limiting, e.g. for a relay that
+	// returns 4xx for temporary errors. Pushover does not, retrying its 4xx
+	// responses only uses up message quota.
+	ClientErrors bool
+
+	// If set, a line is written for each attempt, for -retry-log.
+	Log io.Writer
+}
+
+// groupResult is the response to fetching a delivery group.
+type groupResult struct {
+	Status int    `json:"status"`
+	Name   string `json:"name"`
+	Users  []struct {
+		User     string `json:"user"`
+		Device   string `json:"device"`
+		Memo     string `json:"memo"`
+		Disabled bool   `json:"disabled"`
+	} `json:"users"`
+	Request string `json:"request"`
+}
+
+// sendMessage sends a message, with an optional attachment, retrying according
+// to policy. Retries are done with exponential backoff, but not when the backoff
+// would exceed the deadline of ctx.
+func sendMessage(ctx context.Context, data url.Values, att *attachment, policy retryPolicy) (messageResult, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := sendMessageOnce(ctx, data, att, policy.RateLimit)
+		var statusCode int
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			statusCode = apiErr.StatusCode
+		}
+		logAttempt := func(backoff time.Duration) {
+			if policy.Log == nil {
+				return
+			}
+			line := fmt.Sprintf("%s attempt=%d", time.Now().Format(time.RFC3339), attempt+1)
+			if err == nil {
+				line += fmt.Sprintf(" result=ok request=%s", result.Request)
+			} else {
+				line += fmt.Sprintf(" result=error status=%d error=%q", statusCode, err.Error())
+			}
+			if backoff > 0 {
+				line += fmt.Sprintf(" backoff=%s", backoff)
+			}
+			if _, err := fmt.Fprintln(policy.Log, line); err != nil {
+				log.Printf("writing retry log: %s", err)
+			}
+		}
+		if err == nil || attempt >= policy.Retries || !isRetryable(statusCode, err, policy.ClientErrors) {
+			logAttempt(0)
+			return result, err
+		}
+		backoff := min(time.Second<<attempt, time.Minute)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			logAttempt(0)
+			return result, err
+		}
+		logAttempt(backoff)
+		log.Printf("sending message: %s, retrying in %s", err, backoff)
+		if err := sleep(ctx, backoff); err != nil {
+			return result, err
+		}
+	}
+}
+
+// isRetryable returns whether an api call that failed with err, or with
+// statusCode if the api returned a response, can be retried. Connection errors,
+// timeouts of a connection, rate limiting and server errors are retryable.
+// Other client errors, and a canceled or expired context, are not, unless
+// clientErrors is set. A 200 response that could not be parsed is never
+// retried, the message was already accepted.
+func isRetryable(statusCode int, err error, clientErrors bool) bool {
+	if statusCode != 0 {
+		return statusCode == http.StatusTooManyRequests || statusCode >= 500 || clientErrors && statusCode >= 400
+	}
+	if err == nil || errors.Is(err, errParseResponse) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return true
+}
+
+// sendMessageOnce sends a message. If the message quota has been reached and
+// retryRateLimit is set, and the quota resets before the deadline of ctx, we
+// wait and try once more.
+func sendMessageOnce(ctx context.Context, data url.Values, att *attachment, retryRateLimit bool) (messageResult, error) {
+	var result messageResult
+	err := postMessage(ctx, data, att, &result)
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		return result, err
+	}
+	reset, ok := rateLimitReset(apiErr.Header)
+	if !ok {
+		return result, fmt.Errorf("message quota exhausted: %w", err)
+	}
+	deadline, _ := ctx.Deadline()
+	if !retryRateLimit || reset.After(deadline) {
+		return result, fmt.Errorf("message quota exhausted until %s: %w", formatTime(reset), err)
+	}
+	log.Printf("message quota exhausted, waiting until reset at %s", formatTime(reset))
+	if err := sleep(ctx, time.Until(reset)); err != nil {
+		return result, err
+	}
+	err = postMessage(ctx, data, att, &result)
+	return result, err
+}
+
+// postMessage sends a message, storing the response in result, including the
+// remaining message quota from the response headers.
+func postMessage(ctx context.Context, data url.Values, att *attachment, result *messageResult) error {
+	h, err := apiPostAttachment(ctx, messagesPath, data, att, result)
+	result.Remaining = -1
+	if v, err := strconv.Atoi(h.Get("X-Limit-App-Remaining")); err == nil {
+		result.Remaining = v
+	}
+	return err
+}
+
+// location is used for formatting times, set with -tz.
+var location = time.Local
+
+// formatTime formats t for display, in the location for display.
+func formatTime(t time.Time) string {
+	return t.In(location).Format(time.RFC3339)
+}
+
+// rateLimitReset returns the time the message quota resets, from the
+// X-Limit-App-Reset header.
+func rateLimitReset(h http.Header) (time.Time, bool) {
+	v, err := strconv.ParseInt(h.Get("X-Limit-App-Reset"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(v, 0), true
+}
+
+// quotaWait returns how long to wait for the message quota to reset, for
+// -wait-on-quota, from the headers h of a rate limited response. An error is
+// returned if the reset time is missing, beyond maxWait, or after deadline if
+// it is not zero.
+func quotaWait(h http.Header, maxWait time.Duration, deadline time.Time) (time.Duration, error) {
+	reset, ok := rateLimitReset(h)
+	if !ok {
+		return 0, fmt.Errorf("no reset time in response")
+	}
+	d := time.Until(reset)
+	if d > maxWait {
+		return 0, fmt.Errorf("quota resets at %s, beyond -max-wait", formatTime(reset))
+	}
+	if !deadline.IsZero() && reset.After(deadline) {
+		return 0, fmt.Errorf("quota resets at %s, after -deadline", formatTime(reset))
+	}
+	return max(d, 0), nil
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// thresholdSound returns the sound for -loud-above: loud for priorities at or
+// above threshold, quiet otherwise, with defaults for empty sounds.
+func thresholdSound(priority, threshold int, loud, quiet string) string {
+	if priority >= threshold {
+		if loud == "" {
+			return "siren"
+		}
+		return loud
+	}
+	if quiet == "" {
+		return "none"
+	}
+	return quiet
+}
+
+// prioritySound returns the sound for -sound-by-priority.
+func prioritySound(priority int) string {
+	switch {
+	case priority >= 2:
+		return "siren"
+	case priority == 1:
+		return "tugboat"
+	case priority == 0:
+		return "pushover"
+	}
+	return "none"
+}
+
+// apiPost sends data as form to the pushover api at path (relative to apiBase),
+// and parses the json response into result.
+func apiPost(ctx context.Context, path string, data url.Values, result any) error {
+	_, err := apiPostAttachment(ctx, path, data, nil, result)
+	return err
+}
+
+// apiPostAttachment is like apiPost, but sends data as multipart form with the
+// attachment, if att is not nil. The response headers are returned.
+func apiPostAttachment(ctx context.Context, path string, data url.Values, att *attachment, result any) (http.Header, error) {
+	if jsonBody {
+		body, err := jsonForm(data, att)
+		if err != nil {
+			return nil, fmt.Errorf("making json body: %w", err)
+		}
+		return apiDo(ctx, http.MethodPost, path, "application/json", body, att != nil && uploadProgress, result)
+	}
+	if att == nil {
+		return apiDo(ctx, http.MethodPost, path, "application/x-www-form-urlencoded", []byte(data.Encode()), false, result)
+	}
+	body, ct, err := multipartForm(data, att)
+	if err != nil {
+		return nil, fmt.Errorf("making multipart form: %w", err)
+	}
+	return apiDo(ctx, http.MethodPost, path, ct, body, uploadProgress, result)
+}
+
+// jsonForm returns data as json object, for -content-type json. Fields with a
+// single value are strings, others arrays of strings. The attachment is added
+// as fields attachment_base64 and attachment_type.
+func jsonForm(data url.Values, att *attachment) ([]byte, error) {
+	m := map[string]any{}
+	for k, l := range data {
+		if len(l) == 1 {
+			m[k] = l[0]
+		} else {
+			m[k] = l
+		}
+	}
+	if att != nil {
+		m["attachment_base64"] = base64.StdEncoding.EncodeToString(att.Data)
+		m["attachment_type"] = att.Type
+	}
+	return json.Marshal(m)
+}
+
+// apiGet requests path with query parameters from the pushover api, and parses
+// the json response into result.
+func apiGet(ctx context.Context, path string, query url.Values, result any) error {
+	_, err := apiDo(ctx, http.MethodGet, path+"?"+query.Encode(), "", nil, false, result)
+	return err
+}
+
+// newRequest returns a request with method to the pushover api at path, with
+// body of content-type ct if not empty. The body can be read again with GetBody.
+// If progress is set, upload progress is printed to stderr.
+func newRequest(ctx context.Context, method, path, ct string, body []byte, progress bool) (*http.Request, error) {
+	var r io.Reader = bytes.NewReader(body)
+	if progress {
+		total := int64(len(body))
+		var pct int64
+		r = &progressReader{ctx: ctx, r: r, fn: func(n int64) {
+			// Print at every 10% step.
+			if p := n * 100 / total; p/10 > pct/10 || n == total {
+				pct = p
+				log.Printf("upload: %d/%d bytes (%d%%)", n, total, p)
+			}
+		}}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiBase+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	// For retries by the http client, e.g. after a redirect or a closed idle
+	// connection. Retries by sendMessage make a new request, with a new body from
+	// the attachment data in memory.
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	return req, nil
+}
+
+// apiDo does a request with method to the pushover api at path, with body of
+// content-type ct if not empty, and parses the json response into result,
+// returning the response headers. The request is made with newRequest.
+func apiDo(ctx context.Context, method, path, ct string, body []byte, progress bool, result any) (http.Header, error) {
+	req, err := newRequest(ctx, method, path, ct, body, progress)
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("api request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if dumpHeaders {
+		fmt.Fprintf(os.Stderr, "%s %s\n", resp.Proto, resp.Status)
+		for _, k := range slices.Sorted(maps.Keys(resp.Header)) {
+			for _, v := range resp.Header[k] {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", k, v)
+			}
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, err := readErrorBody(resp)
+		if err != nil {
+			log.Printf("warning: reading error response body: %v", err)
+		}
+		return resp.Header, &apiError{resp.StatusCode, resp.Status, resp.Header, respBody}
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	if strictJSON {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(result); err != nil {
+		return resp.Header, fmt.Errorf("%w: %w", errParseResponse, err)
+	}
+	return resp.Header, nil
+}
+
+// readErrorBody reads the start of the body of an error response, decompressing
+// gzip content-encoding, and converting from latin1 charsets to utf-8, for
+// responses from proxies.
+func readErrorBody(resp *http.Response) ([]byte, error) {
+	var r io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gzr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		defer gzr.Close()
+		r = gzr
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, 1024))
+	if _, params, perr := mime.ParseMediaType(resp.Header.Get("Content-Type")); perr == nil {
+		switch strings.ToLower(params["charset"]) {
+		case "iso-8859-1", "latin1", "windows-1252":
+			// Windows-1252 is mostly a superset of latin1.
+			rs := make([]rune, len(buf))
+			for i, c := range buf {
+				rs[i] = rune(c)
+			}
+			buf = []byte(string(rs))
+		}
+	}
+	return buf, err
+}
+
+// recipient is a destination for messages.
+type recipient struct {
+	user   string
+	device string // Optional.
+}
+
+// resolveUser resolves s, a user/group key or an "@" followed by the name of an
+// alias from the config file, into a user key and optional device.
+func resolveUser(s string) (user, device string, err error) {
+	if !strings.HasPrefix(s, "@") {
+		return s, "", nil
+	}
+	v, ok := config.Aliases[s[1:]]
+	if !ok {
+		return "", "", fmt.Errorf("unknown alias %q", s[1:])
+	}
+	user, device, _ = strings.Cut(v, ":")
+	if user == "" {
+		return "", "", fmt.Errorf("alias %q has empty user key", s[1:])
+	}
+	return user, device, nil
+}
+
 func main() {
 	var configPath = "/etc/pushover.conf"
 	var priority string
@@ -43,17 +634,213 @@ func main() {
 	var expire = 3600
 	var timeout = 30 * time.Second
 	var printConfig bool
+	var printRequestID bool
+	var tags string
+	var cancelByTag string
+	var failOpen bool
+	var chunk bool
+	var users stringList
+	var device string
+	var trace bool
+	var saveConfig string
+	var confirm bool
+	var force bool
+	var messages stringList
+	var policy retryPolicy
+	var verifyDevice bool
+	var templateFile string
+	var vars stringList
+	var monospace bool
+	var emphasis bool
+	var link string
+	var stateDir string
+	var dedup bool
+	var dedupCacheSize = 100
+	var batchStdin bool
+	var interval time.Duration
+	var coalesce bool
+	var http1 bool
+	var jsonOutput bool
+	var noTitle bool
+	var sound string
+	var soundByPriority bool
+	var idleTimeout = 90 * time.Second
+	var dumpCurl bool
+	var callback string
+	var tz string
+	var stdinAttachment bool
+	var attachmentType string
+	var truncateTitle bool
+	var sendIfFileExists string
+	var sendIfFileMissing string
+	var debugConfig bool
+	var outputTemplate string
+	var verbose bool
+	var groupMembers bool
+	var noSend bool
+	var cooldown time.Duration
+	var attachmentResize bool
+	var healthcheckMode bool
+	var silent bool
+	var waitOnQuota bool
+	var maxWait = 24 * time.Hour
+	var receiptFile string
+	var checkReceiptsMode bool
+	var redacts stringList
+	var maxAttempts int
+	var prefer = "error"
+	var countMode bool
+	var fields stringList
+	var minPriority string
+	var exitCode = -1
+	var metricsPath string
+	var correlationID string
+	var ackListen string
+	var waitAck bool
+	var ackInterval = 10 * time.Second
+	var contentType = "form"
+	var loudAbove string
+	var preflight bool
+	var join = " "
+	var execMode bool
+	var titleTemplate string
+	var maxBodyPreview = 80
+	var noRetryOn400 = true
+	var deadlineStr string
+	var refreshSounds bool
+	var allowEmpty bool
+	var delay time.Duration
+	var printFeatures bool
+	var summaryMode bool
+	var prefixTimestamp string
+	var appToken string
+	var htmlFlag bool
+	var loudSound string
+	var quietSound string
+	var listenAddr string
+	var collapseWhitespace bool
+	var bodyBase64 string
+	var retryLog string
+	var confirmAbove int
+	var messagesPathFlag string
+
+	if dir, err := os.UserCacheDir(); err == nil {
+		stateDir = filepath.Join(dir, "pushover")
+	}
 
 	log.SetFlags(0)
 	flag.BoolVar(&printConfig, "printconfig", false, "print empty config file and exit")
-	flag.StringVar(&configPath, "configpath", configPath, "path to config file")
-	flag.StringVar(&priority, "priority", priority, "priority to send with: low, lowest, normal (default), high, highest")
+	flag.StringVar(&configPath, "configpath", configPath, "path to config file, or https url to fetch config file from, with a cached copy in the state directory as fallback")
+	flag.StringVar(&priority, "priority", priority, "priority to send with: low, lowest, normal (default, unless set in environment variable PUSHOVER_PRIORITY or config file), high, highest")
 	flag.StringVar(&title, "title", "", "title to show with message, instead of possible value from config file, or the default: the application name")
 	flag.IntVar(&retry, "retry", retry, "interval between resends of highest priority notifications until they are acknowledged; at most 50 retries are attempted by pushover")
-	flag.IntVar(&retry, "expire", expire, "interval after which highest priority notifications aren't retried anymore")
+	flag.IntVar(&expire, "expire", expire, "interval after which highest priority notifications aren't retried anymore")
 	flag.DurationVar(&timeout, "timeout", timeout, "timeout for call to pushover api")
+	flag.BoolVar(&printRequestID, "print-request-id", false, "on success, print the request id returned by pushover to stdout")
+	flag.StringVar(&tags, "tags", "", "comma-separated tags to attach to the message, for canceling retries of highest priority notifications with -cancel-by-tag")
+	flag.StringVar(&cancelByTag, "cancel-by-tag", "", "cancel retries of highest priority notifications that were sent with this tag, instead of sending a message")
+	flag.BoolVar(&failOpen, "fail-open", false, "exit with status 0 when sending the message fails, after printing the error")
+	flag.BoolVar(&chunk, "chunk", false, "split messages longer than the maximum of 1024 characters into multiple messages, sent in order")
+	flag.Var(&users, "user", "user or group key to send to instead of DestKey from the config file; use @name for an alias from the config file; can be repeated to send to multiple recipients, each in its own api call")
+	flag.StringVar(&device, "device", "", "name of device to send to, instead of all devices of the user")
+	flag.BoolVar(&trace, "trace", false, "print timing of the phases of api requests to stderr")
+	flag.StringVar(&saveConfig, "save-config", "", "write config file with the effective configuration, i.e. the config file with values from flags applied, to this path, instead of sending a message")
+	flag.BoolVar(&confirm, "confirm", false, "ask for confirmation on stdin before sending highest priority notifications")
+	flag.BoolVar(&force, "force", false, "do not ask for confirmation, e.g. with -confirm")
+	flag.Var(&messages, "message", "message to send, instead of as arguments, can be repeated to send multiple messages, each in its own api call")
+	flag.BoolVar(&policy.RateLimit, "retry-on-rate-limit", false, "when the message quota is exhausted and resets within the timeout, wait for the reset and try once more")
+	flag.BoolVar(&verifyDevice, "verify-device", false, "before sending, verify with the api that the user has the device specified with -device")
+	flag.StringVar(&templateFile, "template-file", "", "file with go text/template to render into the message, with environment variables and -var values as data")
+	flag.StringVar(&titleTemplate, "title-template", "", "go text/template to render into the title, with environment variables and -var values as data, e.g. 'backup of {{.host}}'")
+	flag.Var(&vars, "var", "key=value for use in templates, takes precedence over environment variables, can be repeated")
+	flag.BoolVar(&monospace, "monospace", false, "show message in monospace font")
+	flag.BoolVar(&emphasis, "emphasis", false, "show message in bold, sends message as html")
+	flag.StringVar(&link, "link", "", "add a link to the message, value is a url optionally followed by a space and the link text; sends message as html")
+	flag.StringVar(&stateDir, "state-dir", stateDir, "directory for state files, e.g. for -dedup and -cooldown")
+	flag.BoolVar(&dedup, "dedup", false, "do not send messages identical to one of the recently sent messages, as remembered in a file in the state directory")
+	flag.IntVar(&dedupCacheSize, "dedup-cache-size", dedupCacheSize, "number of recently sent messages to remember for -dedup")
+	flag.BoolVar(&batchStdin, "batch-stdin", false, "read lines from stdin, sending each non-empty line as a message, until end of file")
+	flag.DurationVar(&interval, "interval", interval, "for -batch-stdin, minimum time between messages, or with -coalesce, time to wait for more lines to combine into one message; for -listen, minimum time between messages, default 1s")
+	flag.BoolVar(&coalesce, "coalesce", false, "for -batch-stdin, combine lines read within -interval into one message")
+	flag.BoolVar(&http1, "http1", false, "only use HTTP/1.1 for api calls, not HTTP/2, e.g. for networks with middleboxes that mishandle HTTP/2")
+	flag.BoolVar(&jsonOutput, "json", false, "print a json array with the result of each message to stdout, including the local time the message was sent")
+	flag.BoolVar(&noTitle, "no-title", false, "do not send a title, also not from the config file, so the application name is shown")
+	flag.StringVar(&sound, "sound", "", "name of sound to play for notification, instead of the default for the user, e.g. none; sounds other than the built-in sounds are checked against the sounds of the application, fetched with the api")
+	flag.BoolVar(&soundByPriority, "sound-by-priority", false, "if -sound is not set, choose a sound based on priority: siren for highest, tugboat for high, pushover for normal, none for low and lowest")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "close connections to the api after being idle for this long, relevant when sending multiple messages")
+	flag.BoolVar(&dumpCurl, "dump-curl", false, "print an equivalent curl command for each message to stderr before sending, with the app token redacted")
+	flag.StringVar(&callback, "callback", "", "https url that pushover calls when a highest priority notification is acknowledged")
+	flag.StringVar(&tz, "tz", "", "time zone for printing times, e.g. Europe/Amsterdam, instead of the local time zone")
+	flag.BoolVar(&stdinAttachment, "stdin-attachment", false, "read an image from stdin and send it as attachment with the message, requires -attachment-type")
+	flag.StringVar(&attachmentType, "attachment-type", "", "mime type of attachment, e.g. image/png")
+	flag.BoolVar(&truncateTitle, "truncate-title", false, "truncate titles longer than the maximum of 250 characters, ending with an ellipsis, instead of failing")
+	flag.BoolVar(&dumpHeaders, "dump-headers", false, "print response headers of api calls to stderr")
+	flag.IntVar(&policy.Retries, "retries", 0, "number of additional attempts for sending a message that failed with a connection error, rate limiting or server error")
+	flag.IntVar(&maxAttempts, "max-attempts", 0, "total number of attempts for sending a message, including the first; alternative to -retries, -max-attempts n is -retries n-1")
+	flag.StringVar(&sendIfFileExists, "send-if-file-exists", "", "only send if this file exists, otherwise exit successfully without sending")
+	flag.StringVar(&sendIfFileMissing, "send-if-file-missing", "", "only send if this file does not exist, otherwise exit successfully without sending")
+	flag.BoolVar(&debugConfig, "debug-config", false, "print the effective configuration, i.e. the config file with values from environment and flags applied, with app token redacted, and exit")
+	flag.BoolVar(&uploadProgress, "progress", false, "print progress of uploading attachments to stderr")
+	flag.StringVar(&outputTemplate, "output-template", "", "go text/template to print to stdout for each message, with fields RequestID, Receipt, Remaining (message quota, -1 if unknown), Duration, CorrelationID and Error")
+	flag.BoolVar(&verbose, "verbose", false, "print details about sending to stderr; the destination is validated with the api to show whether it is a user or group, failures to validate are only logged")
+	flag.BoolVar(&groupMembers, "group-members", false, "if the destination is a delivery group, print its number of members, fetched with the api")
+	flag.BoolVar(&noSend, "no-send", false, "do everything except the api call for sending messages, including updating state for -dedup, and behave as if sending succeeded")
+	flag.DurationVar(&cooldown, "cooldown", 0, "do not send if a message with the same destination and title was sent successfully within this duration, as remembered in a file in the state directory")
+	flag.BoolVar(&attachmentResize, "attachment-resize", false, "scale down images larger than the maximum attachment size of 5MB until they fit, sending them as JPEG")
+	flag.BoolVar(&healthcheckMode, "healthcheck", false, "check connectivity to the api, validity of app token and user key, and remaining message quota, instead of sending a message; exits with status 1 if a check fails")
+	flag.BoolVar(&silent, "silent", false, "send without sound, same as -sound none; highest priority notifications still play the emergency alert sound")
+	flag.BoolVar(&waitOnQuota, "wait-on-quota", false, "when the message quota is exhausted, wait until it resets, e.g. at the start of the next month, and try once more, if the reset is within -max-wait")
+	flag.DurationVar(&maxWait, "max-wait", maxWait, "maximum time to wait with -wait-on-quota")
+	flag.StringVar(&receiptFile, "receipt-file", "", "file to add receipts of sent highest priority notifications to, as json lines, for -check-receipts")
+	flag.BoolVar(&checkReceiptsMode, "check-receipts", false, "check status of the receipts in -receipt-file, removing acknowledged and expired receipts, instead of sending a message")
+	flag.Var(&redacts, "redact", "regular expression of text to replace with *** in messages, e.g. for secrets in logs, can be repeated")
+	flag.StringVar(&prefer, "prefer", prefer, "what to do when a message is both html and monospace, e.g. due to HTML in config file and -monospace: error, html, monospace")
+	flag.BoolVar(&countMode, "count", false, "print the length of each message as it would be sent, i.e. after -emphasis, -link, -prefix-timestamp and -chunk, in characters and bytes, and whether it exceeds the maximum length, instead of sending")
+	flag.Var(&fields, "field", "key=value to add to the api call as form field, e.g. for new api parameters without dedicated flag, can be repeated; fields set by other flags take precedence")
+	flag.StringVar(&minPriority, "min-priority", "", "do not send messages with a lower priority than this, exiting successfully; e.g. for reusing a script with PUSHOVER_PRIORITY at different verbosity")
+	flag.IntVar(&exitCode, "exit-code", exitCode, "exit status of a command that already ran, e.g. $?, to send a success or failure notification for; sets the title, and high priority for non-zero status unless -priority is set; the message is optional")
+	flag.StringVar(&metricsPath, "metrics", "", "file to keep counters in about sent messages, failures, durations and remaining message quota, in prometheus text format, e.g. for the node_exporter textfile collector, which requires a .prom extension")
+	flag.StringVar(&correlationID, "correlation-id", "", "id to add to the api call as form field correlation_id, and to output of -json, -output-template and -verbose, for tracing related notifications through other systems; \"auto\" generates a random id")
+	flag.StringVar(&ackListen, "ack-listen", "", "address to listen on for acknowledgement callbacks of highest priority notifications, e.g. :8080, printing acknowledgements and waiting up to -timeout after sending for all to be acknowledged; -callback must be a url that reaches this listener")
+	flag.BoolVar(&waitAck, "wait-ack", false, "after sending highest priority notifications, poll their receipts until acknowledged or expired, printing the outcome; exits with status 1 if a notification expired without acknowledgement")
+	flag.DurationVar(&ackInterval, "ack-interval", ackInterval, "interval between polls of receipts for -wait-ack, at least 5s")
+	flag.StringVar(&apiBase, "api-base", apiBase, "base url of the api, e.g. of a relay")
+	flag.StringVar(&contentType, "content-type", contentType, "encoding of api calls: form, or json for relays that expect a json body; attachments are sent in json as base64")
+	flag.StringVar(&loudAbove, "loud-above", "", "priority at or above which messages get LoudSound from the config file, with QuietSound for messages below it, unless -sound or -silent is set")
+	flag.BoolVar(&preflight, "preflight", false, "before sending, check that the api can be reached, failing with a clear error if not, e.g. when the network is down")
+	flag.StringVar(&join, "join", join, "separator for joining message arguments, e.g. $'\\n' for a line per argument")
+	flag.BoolVar(&execMode, "exec", false, "run the command in the arguments and send its output as message; if the command fails, its exit status and stderr are added")
+	flag.BoolVar(&strictJSON, "strict-json", false, "fail on unknown fields in api responses, e.g. to notice api changes")
+	flag.IntVar(&maxBodyPreview, "max-body-preview", maxBodyPreview, "number of characters of the message to log after sending with -verbose, longer messages end with an ellipsis; 0 for none")
+	flag.BoolVar(&noRetryOn400, "no-retry-on-400", noRetryOn400, "never retry messages rejected with a 4xx status other than 429 rate limiting, e.g. for an invalid token or parameters, regardless of -retries; only disable for relays that return 4xx for temporary errors")
+	flag.StringVar(&deadlineStr, "deadline", "", "absolute time in RFC3339 format, e.g. 2026-01-02T15:04:05Z, by which api calls must be done, instead of -timeout; fails immediately if in the past")
+	flag.BoolVar(&refreshSounds, "refresh-sounds", false, "fetch the list of sounds for checking the sound from the api, instead of using the list cached in the state directory for up to a day")
+	flag.BoolVar(&allowEmpty, "allow-empty", false, "exit successfully without sending when there are no recipients, i.e. DestKey and -user are empty, instead of failing; with -group-members, also send to groups without members")
+	flag.DurationVar(&delay, "delay", 0, "wait this long before sending, e.g. 10m for a reminder; interrupt to cancel; the delay does not count towards -timeout")
+	flag.BoolVar(&printFeatures, "features", false, "print the supported features and flags, and the version of the pushover api used, as json, and exit")
+	flag.BoolVar(&summaryMode, "summary", false, "print a line with the number of sent, failed and skipped messages to stderr at the end; with -json, the results are printed in an object with fields results and summary")
+	flag.StringVar(&prefixTimestamp, "prefix-timestamp", "", "go time layout, e.g. '2006-01-02 15:04:05', for a timestamp in the -tz time zone to start each message with, for log-style notifications; with -dedup, messages only match if their timestamps are the same, choose a coarse layout, e.g. '2006-01-02', to skip duplicates within a day")
+	flag.StringVar(&appToken, "app-token", "", "app token to use instead of AppToken from the config file; note that command-line arguments can be visible to other users on the system")
+	flag.BoolVar(&htmlFlag, "html", false, "send messages as html, overriding HTML from the config file, e.g. -html=false to send as plain text")
+	flag.StringVar(&loudSound, "loud-sound", "", "sound for -loud-above, instead of LoudSound from the config file")
+	flag.StringVar(&quietSound, "quiet-sound", "", "sound for -loud-above, instead of QuietSound from the config file")
+	flag.StringVar(&listenAddr, "listen", "", "address to listen on for messages posted as json over http, e.g. :8080, which listens on localhost only, for local processes to send messages without access to the app token; requests must have content-type application/json, requests from browsers are rejected; messages are sent one at a time, with at least -interval between them, default 1s; stops on SIGINT or SIGTERM")
+	flag.BoolVar(&collapseWhitespace, "collapse-whitespace", false, "replace runs of spaces and tabs with a single space, and runs of empty lines with a single empty line, to fit more in the maximum message length, e.g. for stack traces")
+	flag.StringVar(&bodyBase64, "body-base64", "", "message as base64, e.g. from \"base64 -w0\", for passing messages with newlines or control characters through a shell without quoting problems")
+	flag.StringVar(&retryLog, "retry-log", "", "file to append a line to for each attempt at sending a message, with attempt number, outcome and backoff before the next attempt, e.g. for finding flaky deliveries with -retries")
+	flag.StringVar(&messagesPathFlag, "messages-path", "", "path of the endpoint for sending messages, relative to -api-base, instead of MessagesPath from the config file, e.g. for relays that mount it elsewhere")
+	flag.IntVar(&confirmAbove, "confirm-above", 0, "ask for confirmation before sending to more than this many recipients, as given with -user; refuses to send if stdin is not a terminal, unless -force is set; 0 to never ask")
 	flag.Usage = func() {
-		log.Println("usage: pushover [flags] message...")
+		log.Println("usage: pushover [flags] [--] message...")
+		log.Println("       pushover [flags] -message message ...")
+		log.Println("       pushover [flags] -batch-stdin")
+		log.Println("       pushover [flags] -exec command [arg ...]")
+		log.Println("       pushover [flags] -listen address")
+		log.Println("       pushover [flags] -cancel-by-tag tag")
+		log.Println("       pushover [flags] -save-config path")
+		log.Println("       pushover [flags] -debug-config")
+		log.Println("       pushover [flags] -healthcheck")
+		log.Println("       pushover [flags] -receipt-file path -check-receipts")
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
@@ -64,65 +851,1511 @@ func main() {
 		os.Exit(0)
 	}
 
-	args := flag.Args()
-	if len(args) == 0 {
-		flag.Usage()
+	if printFeatures {
+		f := struct {
+			APIVersion string   `json:"api_version"`
+			Features   []string `json:"features"`
+			Flags      []string `json:"flags"`
+		}{APIVersion: "1", Features: features}
+		flag.VisitAll(func(fl *flag.Flag) {
+			f.Flags = append(f.Flags, fl.Name)
+		})
+		buf, err := json.MarshalIndent(f, "", "\t")
+		xcheckf(err, "marshal features")
+		fmt.Println(string(buf))
+		os.Exit(0)
 	}
-	msg := strings.Join(args, " ")
 
-	err := sconf.ParseFile(configPath, &config)
-	xcheckf(err, "parsing config file")
+	if v := os.Getenv("PUSHOVER_PRIORITY"); v != "" && priority == "" {
+		_, err := parsePriority(v)
+		xcheckf(err, "parsing environment variable PUSHOVER_PRIORITY")
+		priority = v
+	}
 
-	// https://pushover.net/api
-	data := url.Values{}
-	data.Set("token", config.AppToken)
-	data.Set("user", config.DestKey)
-	data.Set("message", msg)
-	var p string
-	switch priority {
-	case "lowest", "-2":
-		p = "-2"
-	case "low", "-1":
-		p = "-1"
-	case "", "normal", "0":
-		p = "0"
-	case "high", "1":
-		p = "1"
-	case "highest", "2":
-		p = "2"
+	// With -deadline, contexts for api calls get the absolute deadline instead of
+	// -timeout. Timeout is still set for uses that need a duration.
+	var deadline time.Time
+	if deadlineStr != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "timeout" {
+				log.Printf("cannot combine -deadline and -timeout")
+				flag.Usage()
+			}
+		})
+		var err error
+		deadline, err = time.Parse(time.RFC3339, deadlineStr)
+		if err != nil {
+			log.Printf("parsing -deadline: %s", err)
+			flag.Usage()
+		}
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			log.Fatalf("deadline %s has passed", deadlineStr)
+		}
+	}
+	newContext := func() (context.Context, context.CancelFunc) {
+		if !deadline.IsZero() {
+			return context.WithDeadline(apiContext(trace), deadline)
+		}
+		return context.WithTimeout(apiContext(trace), timeout)
+	}
+
+	switch contentType {
+	case "form":
+	case "json":
+		jsonBody = true
 	default:
-		log.Printf("invalid priority value %q", priority)
+		log.Printf("unknown -content-type %q, must be form or json", contentType)
+		flag.Usage()
+	}
+	if !strings.HasSuffix(apiBase, "/") {
+		apiBase += "/"
+	}
+
+	args := flag.Args()
+	if stdinAttachment {
+		if attachmentType == "" {
+			log.Printf("-stdin-attachment requires -attachment-type")
+			flag.Usage()
+		}
+		if batchStdin {
+			log.Printf("cannot combine -stdin-attachment and -batch-stdin, both read from stdin")
+			flag.Usage()
+		}
+		// Only messages can have attachments, other modes don't send messages.
+		modes := []struct {
+			name string
+			set  bool
+		}{
+			{"-cancel-by-tag", cancelByTag != ""},
+			{"-save-config", saveConfig != ""},
+			{"-debug-config", debugConfig},
+			{"-healthcheck", healthcheckMode},
+			{"-check-receipts", checkReceiptsMode},
+			{"-count", countMode},
+		}
+		for _, m := range modes {
+			if m.set {
+				log.Printf("cannot combine -stdin-attachment and %s, attachments can only be sent with messages", m.name)
+				flag.Usage()
+			}
+		}
+	} else if attachmentType != "" || attachmentResize {
+		log.Printf("-attachment-type and -attachment-resize require -stdin-attachment")
+		flag.Usage()
+	}
+	if noTitle && title != "" {
+		log.Printf("cannot combine -title and -no-title")
+		flag.Usage()
+	}
+	var nout int
+	for _, b := range []bool{printRequestID, jsonOutput, outputTemplate != ""} {
+		if b {
+			nout++
+		}
+	}
+	if nout > 1 {
+		log.Printf("can only use one of -print-request-id, -json and -output-template")
+		flag.Usage()
+	}
+	var outputTmpl *template.Template
+	if outputTemplate != "" {
+		var err error
+		outputTmpl, err = template.New("output").Parse(outputTemplate)
+		xcheckf(err, "parsing output template")
+	}
+	if maxAttempts != 0 {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "retries" {
+				log.Printf("cannot combine -retries and -max-attempts")
+				flag.Usage()
+			}
+		})
+		if maxAttempts < 1 {
+			log.Printf("-max-attempts must be at least 1")
+			flag.Usage()
+		}
+		policy.Retries = maxAttempts - 1
+	}
+	policy.ClientErrors = !noRetryOn400
+	if retryLog != "" {
+		f, err := os.OpenFile(retryLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		xcheckf(err, "opening retry log")
+		defer f.Close()
+		policy.Log = f
+	}
+	if ackListen != "" && batchStdin {
+		log.Printf("cannot combine -ack-listen and -batch-stdin")
+		flag.Usage()
+	}
+	if waitAck {
+		if batchStdin || ackListen != "" {
+			log.Printf("cannot combine -wait-ack with -batch-stdin or -ack-listen")
+			flag.Usage()
+		}
+		if ackInterval < minAckInterval {
+			log.Printf("-ack-interval must be at least %s", minAckInterval)
+			flag.Usage()
+		}
+	}
+	if dedupCacheSize < 1 {
+		log.Printf("-dedup-cache-size must be at least 1")
+		flag.Usage()
+	}
+	if maxBodyPreview < 0 {
+		log.Printf("-max-body-preview cannot be negative")
+		flag.Usage()
+	}
+	if checkReceiptsMode && receiptFile == "" {
+		log.Printf("-check-receipts requires -receipt-file")
 		flag.Usage()
 	}
-	if p != "0" {
-		data.Set("priority", p)
+	if listenAddr != "" && (batchStdin || ackListen != "" || waitAck || stdinAttachment) {
+		log.Printf("cannot combine -listen with -batch-stdin, -ack-listen, -wait-ack or -stdin-attachment")
+		flag.Usage()
+	}
+	if cancelByTag != "" || saveConfig != "" || debugConfig || healthcheckMode || checkReceiptsMode || batchStdin || listenAddr != "" {
+		if len(args) != 0 || len(messages) != 0 || templateFile != "" || bodyBase64 != "" {
+			flag.Usage()
+		}
+	} else if len(args) == 0 && len(messages) == 0 && templateFile == "" && exitCode < 0 && bodyBase64 == "" {
+		flag.Usage()
+	} else if len(args) > 0 && len(messages) > 0 {
+		log.Printf("cannot combine -message with message as arguments")
+		flag.Usage()
+	}
+	if titleTemplate != "" && (title != "" || noTitle) {
+		log.Printf("cannot combine -title-template with -title or -no-title")
+		flag.Usage()
+	}
+	if templateFile != "" || titleTemplate != "" {
+		tmplData := map[string]string{}
+		for _, kv := range os.Environ() {
+			k, v, _ := strings.Cut(kv, "=")
+			tmplData[k] = v
+		}
+		for _, kv := range vars {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || k == "" {
+				log.Printf("invalid -var %q, must be key=value", kv)
+				flag.Usage()
+			}
+			tmplData[k] = v
+		}
+		if templateFile != "" {
+			msg, err := renderTemplateFile(templateFile, tmplData)
+			xcheckf(err, "rendering template")
+			messages = append(messages, msg)
+		}
+		if titleTemplate != "" {
+			var err error
+			title, err = renderTemplate("title", titleTemplate, tmplData)
+			xcheckf(err, "rendering title template")
+		}
+	}
+	if bodyBase64 != "" {
+		if len(args) > 0 {
+			log.Printf("cannot combine -body-base64 with message as arguments")
+			flag.Usage()
+		}
+		buf, err := base64.StdEncoding.DecodeString(bodyBase64)
+		if err != nil {
+			log.Printf("decoding -body-base64: %s", err)
+			flag.Usage()
+		}
+		if !utf8.Valid(buf) {
+			log.Printf("message from -body-base64 is not valid utf-8")
+			flag.Usage()
+		}
+		messages = append(messages, string(buf))
+	}
+	if execMode {
+		if len(args) == 0 || len(messages) > 0 || templateFile != "" {
+			log.Printf("-exec requires a command as arguments, and cannot be combined with -message or -template-file")
+			flag.Usage()
+		}
+		// The command is run later, once it is clear a message will be sent.
+	} else if len(args) > 0 {
+		messages = append(messages, strings.Join(args, join))
 	}
-	if p == "2" {
-		data.Set("retry", fmt.Sprintf("%d", retry))
-		data.Set("expire", fmt.Sprintf("%d", expire))
+	if exitCode >= 0 {
+		status := "succeeded"
+		if exitCode != 0 {
+			status = fmt.Sprintf("failed with exit code %d", exitCode)
+			if priority == "" {
+				priority = "high"
+			}
+		}
+		if title == "" && !noTitle {
+			title = "Command " + status
+		}
+		if len(messages) == 0 && !execMode {
+			messages = append(messages, "Command "+status+".")
+		}
 	}
 
-	if title == "" {
-		title = config.Title
+	var redactREs []*regexp.Regexp
+	for _, expr := range redacts {
+		re, err := regexp.Compile(expr)
+		xcheckf(err, "parsing regular expression for -redact")
+		redactREs = append(redactREs, re)
 	}
-	if title != "" {
-		data.Set("title", title)
+	redact := func(msg string) string {
+		for _, re := range redactREs {
+			msg = re.ReplaceAllLiteralString(msg, "***")
+		}
+		return msg
+	}
+	// normalize is applied to messages from all sources, before length checks.
+	normalize := func(msg string) string {
+		msg = redact(msg)
+		if collapseWhitespace {
+			msg = squeezeWhitespace(msg)
+		}
+		return msg
+	}
+	for i, msg := range messages {
+		messages[i] = normalize(msg)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	if tz != "" {
+		var err error
+		location, err = time.LoadLocation(tz)
+		xcheckf(err, "loading time zone")
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.pushover.net/1/messages.json", strings.NewReader(data.Encode()))
-	xcheckf(err, "making request")
+	if sendIfFileExists != "" {
+		if _, err := os.Stat(sendIfFileExists); errors.Is(err, os.ErrNotExist) {
+			log.Printf("not sending, %s does not exist", sendIfFileExists)
+			return
+		} else if err != nil {
+			log.Fatalf("checking file for -send-if-file-exists: %s", err)
+		}
+	}
+	if sendIfFileMissing != "" {
+		if _, err := os.Stat(sendIfFileMissing); err == nil {
+			log.Printf("not sending, %s exists", sendIfFileMissing)
+			return
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("checking file for -send-if-file-missing: %s", err)
+		}
+	}
 
-	resp, err := http.DefaultClient.Do(req)
-	xcheckf(err, "api request")
+	httpClient = &http.Client{Transport: newTransport(http1, idleTimeout)}
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		if err != nil {
-			log.Printf("warning: reading error response body: %v", err)
+	var err error
+	if strings.HasPrefix(configPath, "https://") {
+		err = parseConfigURL(configPath, timeout, stateDir)
+	} else {
+		err = sconf.ParseFile(configPath, &config)
+	}
+	xcheckf(err, "parsing config file")
+	// Flags for config fields only override the config file when specified.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "app-token":
+			config.AppToken = appToken
+		case "html":
+			config.HTML = htmlFlag
+		case "loud-sound":
+			config.LoudSound = loudSound
+		case "quiet-sound":
+			config.QuietSound = quietSound
+		case "messages-path":
+			config.MessagesPath = messagesPathFlag
+		}
+	})
+	if config.Priority != "" {
+		_, err := parsePriority(config.Priority)
+		xcheckf(err, "parsing Priority in config file")
+	}
+	if config.MessagesPath != "" {
+		if strings.HasPrefix(config.MessagesPath, "/") || strings.Contains(config.MessagesPath, "://") {
+			log.Fatalf("MessagesPath in config file or -messages-path must be relative to the api base url, got %q", config.MessagesPath)
+		}
+		messagesPath = config.MessagesPath
+	}
+	if config.Device != "" && strings.TrimSpace(config.Device) == "" {
+		log.Fatalf("Device in config file is empty")
+	}
+	if config.Retry != 0 && config.Retry < minRetry {
+		log.Fatalf("Retry in config file is %d, must be at least %d", config.Retry, minRetry)
+	}
+	if config.Expire != 0 && (config.Expire < 0 || config.Expire > maxExpire) {
+		log.Fatalf("Expire in config file is %d, must be between 1 and %d", config.Expire, maxExpire)
+	}
+	// The config file provides defaults for -retry and -expire.
+	var retrySet, expireSet bool
+	flag.Visit(func(f *flag.Flag) {
+		retrySet = retrySet || f.Name == "retry"
+		expireSet = expireSet || f.Name == "expire"
+	})
+	if !retrySet && config.Retry != 0 {
+		retry = config.Retry
+	}
+	if !expireSet && config.Expire != 0 {
+		expire = config.Expire
+	}
+	// Only check the config title if it is used, not overridden by -title or -no-title.
+	if n := utf8.RuneCountInString(config.Title); n > maxTitleLength && title == "" && !noTitle {
+		if !truncateTitle {
+			log.Fatalf("Title in config file is %d characters, maximum is %d; shorten it, or use -truncate-title", n, maxTitleLength)
+		}
+		config.Title = truncate(config.Title, maxTitleLength)
+	}
+
+	// Effective config, for -save-config and -debug-config.
+	c := config
+	if len(users) > 1 && (saveConfig != "" || debugConfig) {
+		log.Printf("-save-config and -debug-config take a single -user")
+		flag.Usage()
+	} else if len(users) == 1 {
+		c.DestKey = users[0]
+	}
+	if title != "" {
+		c.Title = title
+	}
+	if priority != "" {
+		_, err := parsePriority(priority)
+		xcheckf(err, "parsing priority")
+		c.Priority = priority
+	}
+	if device != "" {
+		c.Device = device
+	}
+	if retrySet {
+		c.Retry = retry
+	}
+	if expireSet {
+		c.Expire = expire
+	}
+
+	if debugConfig {
+		if c.AppToken != "" {
+			c.AppToken = "REDACTED"
+		}
+		err := sconf.Write(os.Stdout, c)
+		xcheckf(err, "writing config")
+		return
+	}
+
+	if saveConfig != "" {
+		var b bytes.Buffer
+		err := sconf.Write(&b, c)
+		xcheckf(err, "writing config")
+		err = os.WriteFile(saveConfig, b.Bytes(), 0600)
+		xcheckf(err, "writing config file")
+		// An existing file keeps its permissions.
+		fi, err := os.Stat(saveConfig)
+		xcheckf(err, "stat config file")
+		if fi.Mode()&0077 != 0 {
+			log.Printf("warning: config file %s, which contains the app token, has permissions %s, accessible by others", saveConfig, fi.Mode().Perm())
+		}
+		return
+	}
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	if checkReceiptsMode {
+		ok, err := checkReceipts(ctx, config.AppToken, receiptFile)
+		xcheckf(err, "checking receipts")
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cancelByTag != "" {
+		data := url.Values{}
+		data.Set("token", config.AppToken)
+		var result struct {
+			Status   int    `json:"status"`
+			Canceled int    `json:"canceled"`
+			Request  string `json:"request"`
+		}
+		err := apiPost(ctx, "receipts/cancel_by_tag/"+url.PathEscape(cancelByTag)+".json", data, &result)
+		xcheckf(err, "canceling by tag")
+		log.Printf("canceled %d notifications", result.Canceled)
+		return
+	}
+
+	data := url.Values{}
+	data.Set("token", config.AppToken)
+	defaultDevice := device
+	if len(users) == 0 {
+		users = stringList{config.DestKey}
+		if defaultDevice == "" {
+			defaultDevice = config.Device
+		}
+	}
+	var recipients []recipient
+	for _, s := range users {
+		user, aliasDevice, err := resolveUser(s)
+		xcheckf(err, "resolving user")
+		if user == "" {
+			continue
+		}
+		r := recipient{user, defaultDevice}
+		if r.device == "" {
+			r.device = aliasDevice
+		}
+		recipients = append(recipients, r)
+	}
+	if len(recipients) == 0 {
+		if allowEmpty {
+			log.Printf("no recipients, not sending")
+			return
+		}
+		log.Fatalf("no recipients, DestKey in config file and -user are empty; use -allow-empty to exit successfully without sending")
+	}
+
+	if healthcheckMode {
+		ok := true
+		for _, r := range recipients {
+			if !healthcheck(ctx, config.AppToken, r.user) {
+				ok = false
+			}
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if priority == "" {
+		priority = config.Priority
+	}
+	p, err := parsePriority(priority)
+	if err != nil {
+		log.Printf("%s", err)
+		flag.Usage()
+	}
+	minp := -2
+	if minPriority != "" {
+		minp, err = parsePriority(minPriority)
+		if err != nil {
+			log.Printf("-min-priority: %s", err)
+			flag.Usage()
+		}
+	}
+	if ackListen != "" && (p != 2 || callback == "") {
+		log.Printf("-ack-listen requires highest priority and -callback")
+		flag.Usage()
+	}
+	if waitAck && p != 2 {
+		log.Printf("-wait-ack requires highest priority")
+		flag.Usage()
+	}
+	if p != 2 && listenAddr == "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "retry" || f.Name == "expire" || f.Name == "callback" {
+				log.Printf("warning: -%s is only used for highest priority notifications, ignoring", f.Name)
+			}
+		})
+	}
+	if silent {
+		if sound != "" {
+			log.Printf("cannot combine -silent and -sound")
+			flag.Usage()
+		}
+		sound = "none"
+		if p == 2 {
+			log.Printf("warning: -silent does not silence highest priority notifications, pushover still plays the emergency alert sound")
+		}
+	}
+	var threshold int
+	if loudAbove != "" {
+		if soundByPriority {
+			log.Printf("cannot combine -loud-above and -sound-by-priority")
+			flag.Usage()
+		}
+		threshold, err = parsePriority(loudAbove)
+		if err != nil {
+			log.Printf("-loud-above: %s", err)
+			flag.Usage()
+		}
+	}
+
+	// applyPriority sets the fields of data that depend on priority p: priority,
+	// retry, expire, callback and sound. The sound is the one explicitly requested,
+	// if empty it is chosen for p with -loud-above or -sound-by-priority. It
+	// returns false if p is below -min-priority, and an error for an unknown sound.
+	// Used for the flags, and for each message with -listen.
+	applyPriority := func(ctx context.Context, data url.Values, p int, sound string) (bool, error) {
+		if p < minp {
+			return false, nil
+		}
+		for _, k := range []string{"priority", "retry", "expire", "callback", "sound"} {
+			data.Del(k)
+		}
+		if p != 0 {
+			data.Set("priority", fmt.Sprintf("%d", p))
+		}
+		if p == 2 {
+			data.Set("retry", fmt.Sprintf("%d", retry))
+			data.Set("expire", fmt.Sprintf("%d", expire))
+			if callback != "" {
+				data.Set("callback", callback)
+			}
+		}
+		if sound == "" && loudAbove != "" {
+			sound = thresholdSound(p, threshold, config.LoudSound, config.QuietSound)
+		}
+		if sound == "" && soundByPriority {
+			sound = prioritySound(p)
+		}
+		if sound != "" {
+			var path string
+			if stateDir != "" {
+				path = soundsCachePath(stateDir, config.AppToken)
+			}
+			ok, sounds, err := checkSound(ctx, config.AppToken, path, sound, refreshSounds)
+			if err != nil {
+				log.Printf("warning: cannot check if sound %q exists: %s", sound, err)
+			} else if !ok {
+				return false, fmt.Errorf("unknown sound %q, available sounds: %s", sound, strings.Join(slices.Sorted(maps.Keys(sounds)), ", "))
+			}
+			data.Set("sound", sound)
+		}
+		return true, nil
+	}
+	if ok, err := applyPriority(ctx, data, p, sound); err != nil {
+		log.Fatalf("%s", err)
+	} else if !ok && listenAddr == "" {
+		// With -listen, messages can have their own priority.
+		log.Printf("not sending, priority %d is below -min-priority %d", p, minp)
+		return
+	}
+
+	// Only run the command for -exec now, after -send-if-file-exists,
+	// -send-if-file-missing and -min-priority, so it has no side effects when
+	// no message is sent.
+	if execMode {
+		msg, err := execMessage(args)
+		xcheckf(err, "running command for -exec")
+		messages = append(messages, normalize(msg))
+	}
+
+	if tags != "" {
+		l := strings.Split(tags, ",")
+		for i, t := range l {
+			l[i] = strings.TrimSpace(t)
+			if l[i] == "" {
+				log.Printf("empty tag in %q", tags)
+				flag.Usage()
+			}
+		}
+		data.Set("tags", strings.Join(l, ","))
+	}
+
+	if title == "" && !noTitle {
+		title = config.Title
+	}
+	if truncateTitle {
+		title = truncate(title, maxTitleLength)
+	}
+	if title != "" {
+		data.Set("title", title)
+	}
+
+	// Messages can be html, through the config file or -emphasis/-link, or
+	// monospace, not both.
+	isHTML := config.HTML || emphasis || link != ""
+	if isHTML && monospace {
+		switch prefer {
+		case "error":
+			log.Printf("cannot combine html, from HTML in config file, -emphasis or -link, with -monospace; see -prefer")
+			flag.Usage()
+		case "html":
+			monospace = false
+		case "monospace":
+			if emphasis || link != "" {
+				log.Printf("warning: ignoring -emphasis and -link due to -prefer monospace")
+			}
+			isHTML = false
+			emphasis = false
+			link = ""
+		default:
+			log.Printf("invalid value %q for -prefer", prefer)
+			flag.Usage()
+		}
+	}
+	if emphasis || link != "" {
+		if chunk {
+			log.Printf("cannot combine -emphasis or -link with -chunk")
+			flag.Usage()
+		}
+		for i, msg := range messages {
+			messages[i] = formatHTML(msg, emphasis, link)
+		}
+	}
+	if isHTML {
+		data.Set("html", "1")
+	}
+	if monospace {
+		data.Set("monospace", "1")
+	}
+
+	if correlationID == "auto" {
+		buf := make([]byte, 8)
+		_, err := rand.Read(buf)
+		xcheckf(err, "generating correlation id")
+		correlationID = hex.EncodeToString(buf)
+	}
+	if correlationID != "" {
+		data.Set("correlation_id", correlationID)
+		if verbose {
+			log.Printf("correlation id %s", correlationID)
+		}
+	}
+
+	for _, kv := range fields {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			log.Printf("invalid -field %q, must be key=value", kv)
+			flag.Usage()
+		}
+		// Message, user and device are set for each message and recipient when sending.
+		if data.Has(k) || k == "message" || k == "user" || k == "device" {
+			log.Printf("warning: ignoring -field %s, set by other flag or config", k)
+			continue
+		}
+		data.Add(k, v)
+	}
+
+	// With -prefix-timestamp, messages start with the time they were prepared,
+	// counting towards the maximum length.
+	addTimestamp := func(msg string) string {
+		if prefixTimestamp == "" {
+			return msg
+		}
+		ts := time.Now().In(location).Format(prefixTimestamp)
+		if isHTML {
+			ts = html.EscapeString(ts)
+		}
+		return ts + " " + msg
+	}
+
+	var msgs []string
+	for _, msg := range messages {
+		msgs = append(msgs, splitMessage(addTimestamp(msg), chunk)...)
+	}
+
+	// Counted as sent, i.e. after formatting, adding the timestamp and chunking.
+	if countMode {
+		for _, msg := range msgs {
+			n := utf8.RuneCountInString(msg)
+			limit := "within"
+			if n > maxMessageLength {
+				limit = "exceeds"
+			}
+			fmt.Printf("%d characters, %d bytes, %s maximum of %d characters\n", n, len(msg), limit, maxMessageLength)
+		}
+		return
+	}
+
+	var att *attachment
+	if stdinAttachment {
+		att, err = readAttachment(os.Stdin, attachmentType, attachmentResize)
+		xcheckf(err, "reading attachment from stdin")
+	}
+
+	// Check all messages before sending any.
+	for _, m := range msgs {
+		data.Set("message", m)
+		err := validateMessage(data)
+		xcheckf(err, "validating message")
+	}
+
+	if verbose {
+		log.Printf("sending from %s", localIdentity())
+	}
+	for _, r := range recipients {
+		user, device := r.user, r.device
+		if !(verbose || groupMembers || verifyDevice && device != "") {
+			continue
+		}
+		vdata := url.Values{}
+		vdata.Set("token", config.AppToken)
+		vdata.Set("user", user)
+		var result validateResult
+		err := apiPost(ctx, "users/validate.json", vdata, &result)
+		if err != nil && (groupMembers || verifyDevice && device != "") {
+			log.Fatalf("validating user: %s", err)
+		} else if err != nil {
+			// Only for logging, e.g. a relay may not implement validating.
+			log.Printf("warning: validating user for -verbose: %s", err)
+			continue
+		}
+		if result.Group == 1 {
+			if verbose {
+				log.Printf("sending to %s, %s", user, result.describe())
+			}
+			if groupMembers {
+				var gresult groupResult
+				err := apiGet(ctx, "groups/"+url.PathEscape(user)+".json", url.Values{"token": {config.AppToken}}, &gresult)
+				xcheckf(err, "fetching group")
+				log.Printf("group %q has %d members", gresult.Name, len(gresult.Users))
+				if len(gresult.Users) == 0 && !allowEmpty {
+					log.Fatalf("group %q has no members; use -allow-empty to send anyway", gresult.Name)
+				}
+			}
+			if verifyDevice && device != "" {
+				log.Printf("warning: cannot verify device %q, destination is a group", device)
+			}
+		} else {
+			if verbose {
+				log.Printf("sending to %s, %s", user, result.describe())
+			}
+			if verifyDevice && device != "" && !slices.Contains(result.Devices, device) {
+				log.Fatalf("user does not have device %q, devices: %s", device, strings.Join(result.Devices, ", "))
+			}
+		}
+	}
+
+	if confirm && p == 2 && !force {
+		if batchStdin || stdinAttachment {
+			log.Fatalf("cannot ask for confirmation, stdin is used for -batch-stdin or -stdin-attachment; use -force to send without confirmation")
+		}
+		if !isTerminal(os.Stdin) {
+			log.Fatalf("not sending highest priority notification: cannot ask for confirmation, stdin is not a terminal; use -force to send without confirmation")
+		}
+		var l []string
+		for _, r := range recipients {
+			l = append(l, r.user)
+		}
+		fmt.Fprintf(os.Stderr, "sending highest priority notification to %s, title %q:\n", strings.Join(l, ", "), title)
+		for _, m := range msgs {
+			fmt.Fprintf(os.Stderr, "- %q\n", m)
+		}
+		if !askConfirm("send?") {
+			log.Fatalf("not confirmed, not sending")
+		}
+	}
+
+	if confirmAbove > 0 && len(recipients) > confirmAbove && !force {
+		if batchStdin || stdinAttachment {
+			log.Fatalf("cannot ask for confirmation, stdin is used for -batch-stdin or -stdin-attachment; use -force to send without confirmation")
+		}
+		if !isTerminal(os.Stdin) {
+			log.Fatalf("not sending to %d recipients, above -confirm-above %d: cannot ask for confirmation, stdin is not a terminal; use -force to send without confirmation", len(recipients), confirmAbove)
+		}
+		if !askConfirm(fmt.Sprintf("send %d message(s) to %d recipients?", len(msgs), len(recipients))) {
+			log.Fatalf("not confirmed, not sending")
+		}
+	}
+
+	if delay > 0 {
+		sctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		if verbose {
+			log.Printf("waiting %s before sending", delay)
+		}
+		err := sleep(sctx, delay)
+		stop()
+		if err != nil {
+			log.Fatalf("interrupted during -delay, not sending")
+		}
+		// The api timeout starts after the delay.
+		cancel()
+		ctx, cancel = newContext()
+		defer cancel()
+	}
+
+	if preflight {
+		if err := checkConnectivity(ctx); err != nil {
+			host := apiBase
+			if u, err := url.Parse(apiBase); err == nil {
+				host = u.Host
+			}
+			log.Fatalf("cannot reach %s: %s", host, err)
+		}
+	}
+
+	var dedupc *dedupCache
+	if dedup {
+		if stateDir == "" {
+			log.Fatalf("no state directory for -dedup, set one with -state-dir")
+		}
+		dedupc, err = loadDedupCache(filepath.Join(stateDir, "dedup"), dedupCacheSize)
+		xcheckf(err, "loading dedup cache")
+	}
+
+	var cooldownst *cooldownState
+	if cooldown > 0 {
+		if stateDir == "" {
+			log.Fatalf("no state directory for -cooldown, set one with -state-dir")
+		}
+		cooldownst, err = loadCooldown(filepath.Join(stateDir, "cooldown"))
+		xcheckf(err, "loading cooldown state")
+	}
+
+	var metricsf *metricsFile
+	if metricsPath != "" {
+		metricsf, err = loadMetrics(metricsPath)
+		xcheckf(err, "loading metrics")
+	}
+
+	var ackl *ackListener
+	if ackListen != "" {
+		ackl, err = listenAck(ackListen)
+		xcheckf(err, "listening for acknowledgement callbacks")
+		defer ackl.close()
+	}
+
+	// sendTo validates and sends message m with form data to a recipient,
+	// logging errors. The user, device and message are set in data. Messages
+	// identical to recently sent messages are skipped with -dedup, and messages
+	// within -cooldown, returning nil.
+	var sent, failed, skipped int
+	var invalidToken bool
+	sendTo := func(ctx context.Context, data url.Values, r recipient, m string) *sendResult {
+		data.Set("user", r.user)
+		if r.device != "" {
+			data.Set("device", r.device)
+		} else {
+			data.Del("device")
+		}
+		// The title is read from data, it can be set per message with -listen.
+		cooldownk := cooldownKey(r.user, data.Get("title"))
+		data.Set("message", m)
+		if err := validateMessage(data); err != nil {
+			log.Printf("validating message: %s", err)
+			failed++
+			return &sendResult{Time: time.Now(), CorrelationID: correlationID, Error: err.Error()}
+		}
+		var hash string
+		if dedupc != nil {
+			hash = messageHash(data)
+			if dedupc.seen(hash) {
+				log.Printf("not sending duplicate of recently sent message")
+				skipped++
+				return nil
+			}
+		}
+		if dumpCurl {
+			fmt.Fprintln(os.Stderr, curlCommand(apiBase+messagesPath, data, att))
+		}
+		if cooldownst != nil {
+			if t, ok := cooldownst.active(cooldownk, cooldown); ok {
+				log.Printf("not sending message, last message with same destination and title was sent at %s, within cooldown", formatTime(t))
+				skipped++
+				return nil
+			}
+		}
+		start := time.Now()
+		var result messageResult
+		var err error
+		if noSend {
+			log.Printf("not sending message due to -no-send")
+			result.Remaining = -1
+		} else {
+			result, err = sendMessage(ctx, data, att, policy)
+			var apiErr *apiError
+			if waitOnQuota && errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests {
+				if d, werr := quotaWait(apiErr.Header, maxWait, deadline); werr != nil {
+					log.Printf("message quota exhausted, not waiting: %s", werr)
+				} else {
+					log.Printf("message quota exhausted, waiting %s for reset", d.Round(time.Second))
+					// Waiting can be interrupted, and ends at -deadline. The server for -listen
+					// shuts down on the same signals.
+					wctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+					if !deadline.IsZero() {
+						var wcancel context.CancelFunc
+						wctx, wcancel = context.WithDeadline(wctx, deadline)
+						defer wcancel()
+					}
+					err = sleep(wctx, d)
+					stop()
+					if err != nil {
+						err = fmt.Errorf("waiting for message quota reset: %w", err)
+					} else {
+						ctx, cancel := newContext()
+						result, err = sendMessage(ctx, data, att, policy)
+						cancel()
+					}
+				}
+			}
+		}
+		if outputTmpl != nil {
+			od := outputData{result.Request, result.Receipt, result.Remaining, time.Since(start), correlationID, ""}
+			if err != nil {
+				od.Error = err.Error()
+			}
+			if err := outputTmpl.Execute(os.Stdout, od); err != nil {
+				log.Printf("executing output template: %s", err)
+			}
+			fmt.Println()
+		}
+		if metricsf != nil {
+			if err := metricsf.record(start, err == nil, time.Since(start), result.Remaining); err != nil {
+				log.Printf("saving metrics: %s", err)
+			}
+		}
+		if err != nil {
+			var apiErr *apiError
+			if errors.As(err, &apiErr) && apiErr.invalidToken() {
+				invalidToken = true
+				log.Printf("sending message: application token is invalid, check AppToken in config file %s", configPath)
+			} else {
+				log.Printf("sending message: %s", err)
+			}
+			failed++
+			return &sendResult{Time: start, CorrelationID: correlationID, Error: err.Error()}
+		}
+		sent++
+		if receiptFile != "" && result.Receipt != "" {
+			pr := pendingReceipt{result.Receipt, result.Request, start, r.user, data.Get("title"), m}
+			if err := appendReceipt(receiptFile, pr); err != nil {
+				log.Printf("adding receipt to receipt file: %s", err)
+			}
+		}
+		if cooldownst != nil {
+			if err := cooldownst.record(cooldownk, start); err != nil {
+				log.Printf("saving cooldown state: %s", err)
+			}
+		}
+		if dedupc != nil {
+			dedupc.add(hash)
+			if err := dedupc.save(); err != nil {
+				log.Printf("saving dedup cache: %s", err)
+			}
+		}
+		if verbose {
+			if maxBodyPreview > 0 {
+				log.Printf("sent message, request %s: %q", result.Request, truncate(m, maxBodyPreview))
+			} else {
+				log.Printf("sent message, request %s", result.Request)
+			}
+		}
+		if printRequestID {
+			fmt.Println(result.Request)
+		}
+		return &sendResult{Time: start, Request: result.Request, CorrelationID: correlationID, receipt: result.Receipt}
+	}
+
+	var results []sendResult
+	var receipts []string
+
+	// finish prints the results with -json, and the summary with -summary.
+	finish := func() {
+		var summary *sendSummary
+		if summaryMode {
+			summary = &sendSummary{sent, failed, skipped}
+			log.Printf("sent: %d, failed: %d, skipped: %d", sent, failed, skipped)
+		}
+		if jsonOutput {
+			printResults(results, summary)
+		}
+	}
+
+	// send sends a message to each recipient, gathering the results. The
+	// attachment is only read once, a new request body is made for each api call.
+	send := func(ctx context.Context, m string) {
+		for _, r := range recipients {
+			res := sendTo(ctx, data, r, m)
+			if res == nil {
+				continue
+			}
+			results = append(results, *res)
+			if res.receipt != "" {
+				receipts = append(receipts, res.receipt)
+			}
+		}
+	}
+
+	if listenAddr != "" {
+		// Each message gets the full timeout.
+		cancel()
+		addr := listenAddr
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		handle := func(req listenRequest) (listenResponse, int) {
+			// Fields from the request only apply to this message.
+			rdata, rrecipients := maps.Clone(data), recipients
+			bad := func(err error) (listenResponse, int) {
+				return listenResponse{Error: err.Error()}, http.StatusBadRequest
+			}
+
+			if req.User != "" {
+				user, aliasDevice, err := resolveUser(req.User)
+				if err != nil {
+					return bad(err)
+				}
+				r := recipient{user, device}
+				if r.device == "" {
+					r.device = aliasDevice
+				}
+				rrecipients = []recipient{r}
+			}
+			if req.Device != "" {
+				l := slices.Clone(rrecipients)
+				for i := range l {
+					l[i].device = req.Device
+				}
+				rrecipients = l
+			}
+			if req.Title != "" {
+				rdata.Set("title", req.Title)
+			}
+			reqp, reqSound := p, sound
+			if req.Priority != "" {
+				var err error
+				reqp, err = parsePriority(req.Priority)
+				if err != nil {
+					return bad(err)
+				}
+			}
+			if req.Sound != "" {
+				reqSound = req.Sound
+			}
+			ctx, cancel := newContext()
+			defer cancel()
+			if ok, err := applyPriority(ctx, rdata, reqp, reqSound); err != nil {
+				return bad(err)
+			} else if !ok {
+				log.Printf("not sending, priority %d is below -min-priority %d", reqp, minp)
+				return listenResponse{Skipped: true}, http.StatusOK
+			}
+			if req.URL != "" {
+				rdata.Set("url", req.URL)
+			}
+			if req.URLTitle != "" {
+				rdata.Set("url_title", req.URLTitle)
+			}
+
+			msg := normalize(req.Message)
+			if emphasis || link != "" {
+				msg = formatHTML(msg, emphasis, link)
+			}
+			msgs := splitMessage(addTimestamp(msg), chunk)
+			for _, m := range msgs {
+				rdata.Set("message", m)
+				if err := validateMessage(rdata); err != nil {
+					return bad(err)
+				}
+			}
+
+			resp := listenResponse{Skipped: true}
+			status := http.StatusOK
+			for _, m := range msgs {
+				for _, r := range rrecipients {
+					res := sendTo(ctx, rdata, r, m)
+					if res == nil {
+						continue
+					}
+					resp.Skipped = false
+					if res.Error != "" {
+						resp.Error = res.Error
+						status = http.StatusBadGateway
+					} else {
+						resp.Request = res.Request
+					}
+				}
+			}
+			return resp, status
+		}
+		// Rate limited by default, -interval 0 disables the limit.
+		listenInterval := defaultListenInterval
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "interval" {
+				listenInterval = interval
+			}
+		})
+		err := serveMessages(addr, listenInterval, handle)
+		xcheckf(err, "serving messages")
+		return
+	}
+
+	if batchStdin {
+		// Each message gets the full timeout.
+		cancel()
+		batchLines(os.Stdin, interval, coalesce, func(msg string) {
+			msg = normalize(msg)
+			if emphasis || link != "" {
+				msg = formatHTML(msg, emphasis, link)
+			}
+			for _, m := range splitMessage(addTimestamp(msg), chunk) {
+				ctx, cancel := newContext()
+				send(ctx, m)
+				cancel()
+			}
+		})
+		finish()
+		if failed > 0 && !failOpen {
+			os.Exit(failedExitCode(invalidToken))
+		}
+		return
+	}
+
+	// Messages are sent one at a time, we don't want to hit rate limits. We
+	// continue with the next message after a failure.
+	for _, m := range msgs {
+		send(ctx, m)
+	}
+	finish()
+	// Acknowledgements are printed to stdout, unless stdout has the output of
+	// -json, -print-request-id or -output-template.
+	var ackOut io.Writer = os.Stdout
+	if jsonOutput || printRequestID || outputTmpl != nil {
+		ackOut = os.Stderr
+	}
+	var ackErr error
+	if ackl != nil && len(receipts) > 0 {
+		actx, acancel := newContext()
+		ackErr = ackl.wait(actx, receipts, ackOut)
+		acancel()
+	} else if waitAck && len(receipts) > 0 {
+		wctx := apiContext(trace)
+		if !deadline.IsZero() {
+			var wcancel context.CancelFunc
+			wctx, wcancel = context.WithDeadline(wctx, deadline)
+			defer wcancel()
+		}
+		ackErr = waitReceipts(wctx, config.AppToken, receipts, ackInterval, timeout, ackOut)
+	}
+	if ackErr != nil {
+		log.Printf("%s", ackErr)
+	}
+	if failed > 0 {
+		if n := len(msgs) * len(recipients); n > 1 {
+			log.Printf("%d of %d messages failed", failed, n)
+		}
+		if !failOpen {
+			os.Exit(failedExitCode(invalidToken))
+		}
+	}
+	if ackErr != nil {
+		os.Exit(1)
+	}
+}
+
+// localIdentity returns the local user and host, for verbose logging on shared
+// systems. Parts that cannot be looked up are shown as "unknown".
+func localIdentity() string {
+	name := "unknown"
+	if u, err := osuser.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("user %s (uid %d) on host %s", name, os.Getuid(), host)
+}
+
+// failedExitCode returns the exit status after failing to send messages.
+func failedExitCode(invalidToken bool) int {
+	if invalidToken {
+		return exitInvalidToken
+	}
+	return 1
+}
+
+var spaceRunRE = regexp.MustCompile(`[ \t]+`)
+
+// squeezeWhitespace replaces runs of spaces and tabs with a single space,
+// removes trailing whitespace from lines, and replaces runs of empty lines with
+// a single empty line. Leading and trailing empty lines are removed.
+func squeezeWhitespace(s string) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimRight(spaceRunRE.ReplaceAllLiteralString(line, " "), " ")
+		if line == "" && (len(lines) == 0 || lines[len(lines)-1] == "") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSuffix(strings.Join(lines, "\n"), "\n")
+}
+
+// formatHTML returns msg as html, in bold if emphasis is set, followed by a link
+// if link is set. Link is a url, optionally followed by a space and the text for
+// the link.
+func formatHTML(msg string, emphasis bool, link string) string {
+	s := html.EscapeString(msg)
+	if emphasis {
+		s = "<b>" + s + "</b>"
+	}
+	if link != "" {
+		linkURL, text, _ := strings.Cut(link, " ")
+		if text == "" {
+			text = linkURL
+		}
+		s += fmt.Sprintf("\n<a href=\"%s\">%s</a>", html.EscapeString(linkURL), html.EscapeString(text))
+	}
+	return s
+}
+
+// renderTemplateFile executes the template in path with data. Referencing keys
+// not in data is an error. A trailing newline is removed.
+func renderTemplateFile(path string, data map[string]string) (string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return renderTemplate(path, string(buf), data)
+}
+
+// renderTemplate renders text as go text/template with data, failing on
+// missing keys. A trailing newline is removed.
+func renderTemplate(name, text string, data map[string]string) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// validateMessage checks the form data of a message against the limits of the
+// pushover api, without making an api call.
+func validateMessage(data url.Values) error {
+	msg := data.Get("message")
+	if msg == "" {
+		return fmt.Errorf("message is empty")
+	}
+	if n := utf8.RuneCountInString(msg); n > maxMessageLength {
+		return fmt.Errorf("message is %d characters, maximum is %d", n, maxMessageLength)
+	}
+	if n := utf8.RuneCountInString(data.Get("title")); n > maxTitleLength {
+		return fmt.Errorf("title is %d characters, maximum is %d", n, maxTitleLength)
+	}
+	if data.Get("html") == "1" && data.Get("monospace") == "1" {
+		return fmt.Errorf("message cannot be both html and monospace")
+	}
+	var p int
+	if data.Has("priority") {
+		var err error
+		p, err = strconv.Atoi(data.Get("priority"))
+		if err != nil || p < -2 || p > 2 {
+			return fmt.Errorf("invalid priority %q", data.Get("priority"))
+		}
+	}
+	if p == 2 {
+		retry, err := strconv.Atoi(data.Get("retry"))
+		if err != nil || retry < minRetry {
+			return fmt.Errorf("retry for highest priority must be at least %d seconds, got %q", minRetry, data.Get("retry"))
+		}
+		expire, err := strconv.Atoi(data.Get("expire"))
+		if err != nil || expire <= 0 || expire > maxExpire {
+			return fmt.Errorf("expire for highest priority must be between 1 and %d seconds, got %q", maxExpire, data.Get("expire"))
+		}
+		if data.Has("callback") {
+			u, err := url.Parse(data.Get("callback"))
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				return fmt.Errorf("callback must be an https url, got %q", data.Get("callback"))
+			}
+		}
+	}
+	if data.Get("url_title") != "" && data.Get("url") == "" {
+		return fmt.Errorf("url title requires url")
+	}
+	if data.Has("tags") && slices.Contains(strings.Split(data.Get("tags"), ","), "") {
+		return fmt.Errorf("tags cannot be empty, got %q", data.Get("tags"))
+	}
+	return nil
+}
+
+// stringList is a flag that can be repeated, gathering all values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// sendResult is the outcome of sending a message, for -json.
+type sendResult struct {
+	Time          time.Time `json:"time"` // Local time at start of sending.
+	Request       string    `json:"request,omitempty"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Error         string    `json:"error,omitempty"`
+
+	receipt string // For highest priority, not in json output.
+}
+
+// outputData is passed to the -output-template for each message.
+type outputData struct {
+	RequestID     string
+	Receipt       string
+	Remaining     int // Remaining message quota, -1 if unknown.
+	Duration      time.Duration
+	CorrelationID string
+	Error         string
+}
+
+// sendSummary counts outcomes of sending messages, for -summary.
+type sendSummary struct {
+	Sent    int `json:"sent"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"` // Due to -dedup or -cooldown.
+}
+
+// printResults prints results as json to stdout. With a summary, an object
+// with fields results and summary is printed, otherwise just the results.
+func printResults(results []sendResult, summary *sendSummary) {
+	if results == nil {
+		results = []sendResult{}
+	}
+	for i := range results {
+		results[i].Time = results[i].Time.In(location)
+	}
+	var v any = results
+	if summary != nil {
+		v = struct {
+			Results []sendResult `json:"results"`
+			Summary *sendSummary `json:"summary"`
+		}{results, summary}
+	}
+	buf, err := json.MarshalIndent(v, "", "\t")
+	xcheckf(err, "marshal results")
+	fmt.Println(string(buf))
+}
+
+// curlCommand returns a curl command line that posts data to url, with the
+// token redacted. With an attachment, the form is sent as multipart, with the
+// attachment read from stdin.
+func curlCommand(url string, data url.Values, att *attachment) string {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	if jsonBody {
+		rdata := maps.Clone(data)
+		if rdata.Has("token") {
+			rdata.Set("token", "REDACTED")
+		}
+		buf, err := jsonForm(rdata, att)
+		xcheckf(err, "making json body")
+		return "curl -X POST " + quote(url) + " -H 'Content-Type: application/json' --data-binary " + quote(string(buf))
+	}
+	opt := "--data-urlencode"
+	if att != nil {
+		opt = "--form-string"
+	}
+	cmd := "curl -X POST " + quote(url)
+	for _, k := range slices.Sorted(maps.Keys(data)) {
+		for _, v := range data[k] {
+			if k == "token" {
+				v = "REDACTED"
+			}
+			cmd += " " + opt + " " + quote(k+"="+v)
+		}
+	}
+	if att != nil {
+		cmd += " -F " + quote("attachment=@-;type="+att.Type)
+	}
+	return cmd
+}
+
+// isTerminal returns whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// askConfirm prints prompt to stderr and returns whether "y" was read from
+// stdin.
+func askConfirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(line) == "y"
+}
+
+// apiContext returns a context for api calls, with tracing if trace is set.
+func apiContext(trace bool) context.Context {
+	ctx := context.Background()
+	if trace {
+		ctx = httptrace.WithClientTrace(ctx, timingTrace())
+	}
+	return ctx
+}
+
+// timingTrace returns a client trace that logs the phases of a request, with the
+// time elapsed since the start of the request.
+func timingTrace() *httptrace.ClientTrace {
+	var start time.Time
+	logf := func(format string, args ...any) {
+		log.Printf("trace: %s: %s", time.Since(start).Round(time.Millisecond), fmt.Sprintf(format, args...))
+	}
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			start = time.Now()
+			logf("getting connection for %s", hostPort)
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			logf("dns lookup for %s", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			logf("dns lookup done, addrs %v, err %v", info.Addrs, info.Err)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			logf("connected to %s %s, err %v", network, addr, err)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			logf("tls handshake done, err %v", err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			logf("got connection, reused %v", info.Reused)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			logf("wrote request, err %v", info.Err)
+		},
+		GotFirstResponseByte: func() {
+			logf("got first response byte")
+		},
+	}
+}
+
+// truncate returns s if it is at most n characters, and otherwise its first n-1
+// characters followed by an ellipsis.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// splitMessage returns msg as the only message, or with chunk set and msg
+// longer than the maximum message length, split into multiple messages with a
+// " (i/n)" suffix.
+func splitMessage(msg string, chunk bool) []string {
+	if !chunk || utf8.RuneCountInString(msg) <= maxMessageLength {
+		return []string{msg}
+	}
+	// Leave room for the suffix.
+	parts := chunkMessage(msg, maxMessageLength-16)
+	for i := range parts {
+		parts[i] += fmt.Sprintf(" (%d/%d)", i+1, len(parts))
+	}
+	return parts
+}
+
+// chunkMessage splits msg into parts of at most maxLen characters. Parts are split
+// at the last newline in a part if possible, the newline is removed.
+func chunkMessage(msg string, maxLen int) []string {
+	var parts []string
+	r := []rune(msg)
+	for len(r) > maxLen {
+		n := maxLen
+		for i := maxLen - 1; i > 0; i-- {
+			if r[i] == '\n' {
+				n = i
+				break
+			}
+		}
+		parts = append(parts, string(r[:n]))
+		if r[n] == '\n' {
+			n++
 		}
-		log.Fatalf("got status %q, expected 200 ok, body %q", resp.Status, respBody)
+		r = r[n:]
 	}
+	return append(parts, string(r))
 }
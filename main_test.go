@@ -0,0 +1,2920 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mjl-/sconf"
+)
+
+// fakeAPI starts an http server for api calls handled by fn, pointing apiBase
+// and httpClient at it for the duration of the test.
+func fakeAPI(t *testing.T, fn http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(fn)
+	origBase, origClient := apiBase, httpClient
+	apiBase, httpClient = srv.URL+"/", srv.Client()
+	t.Cleanup(func() {
+		srv.Close()
+		apiBase, httpClient = origBase, origClient
+	})
+}
+
+func TestIsRetryable(t *testing.T) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name         string
+		statusCode   int
+		err          error
+		clientErrors bool
+		exp          bool
+	}{
+		{"connection error", 0, fmt.Errorf("api request: %w", netErr), false, true},
+		{"timeout", 0, fmt.Errorf("api request: %w", &net.OpError{Op: "read", Err: errTimeout{}}), false, true},
+		{"rate limited", http.StatusTooManyRequests, errors.New("x"), false, true},
+		{"server error", http.StatusInternalServerError, errors.New("x"), false, true},
+		{"bad gateway", http.StatusBadGateway, errors.New("x"), false, true},
+		{"bad request", http.StatusBadRequest, errors.New("x"), false, false},
+		{"unauthorized", http.StatusUnauthorized, errors.New("x"), false, false},
+		{"not found", http.StatusNotFound, errors.New("x"), false, false},
+		{"bad request with client errors", http.StatusBadRequest, errors.New("x"), true, true},
+		{"canceled", 0, fmt.Errorf("api request: %w", context.Canceled), false, false},
+		{"deadline exceeded", 0, fmt.Errorf("api request: %w", context.DeadlineExceeded), false, false},
+		{"canceled with client errors", 0, context.Canceled, true, false},
+		{"unparsable 200 response", 0, fmt.Errorf("%w: %w", errParseResponse, io.ErrUnexpectedEOF), false, false},
+		{"unparsable 200 response with client errors", 0, fmt.Errorf("%w: %w", errParseResponse, io.ErrUnexpectedEOF), true, false},
+		{"no error", 0, nil, false, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.statusCode, tt.err, tt.clientErrors); got != tt.exp {
+			t.Errorf("%s: isRetryable(%d, %v, %v) = %v, expected %v", tt.name, tt.statusCode, tt.err, tt.clientErrors, got, tt.exp)
+		}
+	}
+}
+
+type errTimeout struct{}
+
+func (errTimeout) Error() string { return "i/o timeout" }
+func (errTimeout) Timeout() bool { return true }
+
+// validMessage returns form data for a message that passes validation.
+func validMessage() url.Values {
+	return url.Values{"token": {"token"}, "user": {"user"}, "message": {"hi"}}
+}
+
+func TestValidateMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(data url.Values)
+		expErr string // Substring of error, empty for no error.
+	}{
+		{"valid", func(data url.Values) {}, ""},
+		{"empty message", func(data url.Values) { data.Set("message", "") }, "message is empty"},
+		{"max message", func(data url.Values) { data.Set("message", strings.Repeat("é", maxMessageLength)) }, ""},
+		{"long message", func(data url.Values) { data.Set("message", strings.Repeat("é", maxMessageLength+1)) }, "message is 1025 characters"},
+		{"long title", func(data url.Values) { data.Set("title", strings.Repeat("x", maxTitleLength+1)) }, "title is 251 characters"},
+		{"html and monospace", func(data url.Values) { data.Set("html", "1"); data.Set("monospace", "1") }, "both html and monospace"},
+		{"priority out of range", func(data url.Values) { data.Set("priority", "3") }, "invalid priority"},
+		{"priority not a number", func(data url.Values) { data.Set("priority", "high") }, "invalid priority"},
+		{"lowest priority", func(data url.Values) { data.Set("priority", "-2") }, ""},
+		{"highest without retry", func(data url.Values) { data.Set("priority", "2"); data.Set("expire", "3600") }, "retry for highest priority"},
+		{"highest with low retry", func(data url.Values) {
+			data.Set("priority", "2")
+			data.Set("retry", "29")
+			data.Set("expire", "3600")
+		}, "retry for highest priority"},
+		{"highest with long expire", func(data url.Values) {
+			data.Set("priority", "2")
+			data.Set("retry", "30")
+			data.Set("expire", "10801")
+		}, "expire for highest priority"},
+		{"highest with http callback", func(data url.Values) {
+			data.Set("priority", "2")
+			data.Set("retry", "30")
+			data.Set("expire", "10800")
+			data.Set("callback", "http://example.com/ack")
+		}, "callback must be an https url"},
+		{"highest", func(data url.Values) {
+			data.Set("priority", "2")
+			data.Set("retry", "30")
+			data.Set("expire", "10800")
+			data.Set("callback", "https://example.com/ack")
+		}, ""},
+		{"empty tag", func(data url.Values) { data.Set("tags", "a,,b") }, "tags cannot be empty"},
+		{"url title without url", func(data url.Values) { data.Set("url_title", "x") }, "url title requires url"},
+		{"url title", func(data url.Values) { data.Set("url_title", "x"); data.Set("url", "https://example.com") }, ""},
+	}
+	for _, tt := range tests {
+		data := validMessage()
+		tt.modify(data)
+		err := validateMessage(data)
+		if tt.expErr == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.expErr != "" && (err == nil || !strings.Contains(err.Error(), tt.expErr)) {
+			t.Errorf("%s: got error %v, expected error with %q", tt.name, err, tt.expErr)
+		}
+	}
+}
+
+func TestChunkMessage(t *testing.T) {
+	tests := []struct {
+		msg    string
+		maxLen int
+		exp    []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"0123456789", 10, []string{"0123456789"}},
+		{"0123456789abc", 10, []string{"0123456789", "abc"}},
+		{"0123\n56789abc", 10, []string{"0123", "56789abc"}},
+		{"ééééé", 2, []string{"éé", "éé", "é"}},
+		{"ab\ncd\nef", 4, []string{"ab", "cd", "ef"}},
+	}
+	for _, tt := range tests {
+		if got := chunkMessage(tt.msg, tt.maxLen); !slices.Equal(got, tt.exp) {
+			t.Errorf("chunkMessage(%q, %d) = %q, expected %q", tt.msg, tt.maxLen, got, tt.exp)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	long := strings.Repeat("x", 2*maxMessageLength)
+
+	if got := splitMessage(long, false); !slices.Equal(got, []string{long}) {
+		t.Errorf("splitMessage without chunk changed message")
+	}
+	if got := splitMessage("short", true); !slices.Equal(got, []string{"short"}) {
+		t.Errorf("splitMessage of short message = %q", got)
+	}
+
+	parts := splitMessage(long, true)
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts, expected 3", len(parts))
+	}
+	var joined string
+	for i, p := range parts {
+		suffix := fmt.Sprintf(" (%d/3)", i+1)
+		if !strings.HasSuffix(p, suffix) {
+			t.Errorf("part %d %q does not end with %q", i, p, suffix)
+		}
+		if err := validateMessage(url.Values{"message": {p}}); err != nil {
+			t.Errorf("part %d: %v", i, err)
+		}
+		joined += strings.TrimSuffix(p, suffix)
+	}
+	if joined != long {
+		t.Errorf("parts without suffixes do not make up the message")
+	}
+}
+
+func TestSqueezeWhitespace(t *testing.T) {
+	tests := []struct {
+		in, exp string
+	}{
+		{"", ""},
+		{"a b", "a b"},
+		{"a  \t b", "a b"},
+		{"a  \nb\t\n", "a\nb"},
+		{"a\n\n\n\nb", "a\n\nb"},
+		{"\n\na\n \n\t\n\nb\n\n", "a\n\nb"},
+	}
+	for _, tt := range tests {
+		if got := squeezeWhitespace(tt.in); got != tt.exp {
+			t.Errorf("squeezeWhitespace(%q) = %q, expected %q", tt.in, got, tt.exp)
+		}
+	}
+
+	// A stack trace with many blank lines fits after squeezing.
+	trace := strings.Repeat("goroutine 1 [running]:\n\n\n\n\t\tmain.main()\n\n\n", 25)
+	got := squeezeWhitespace(trace)
+	if n := len(got); len(trace) <= maxMessageLength || n > maxMessageLength {
+		t.Errorf("squeezed trace is %d bytes, original %d", n, len(trace))
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	orig := config.Aliases
+	config.Aliases = map[string]string{
+		"alice": "ALICEKEY",
+		"phone": "BOBKEY:iphone",
+		"empty": ":ipad",
+	}
+	t.Cleanup(func() { config.Aliases = orig })
+
+	tests := []struct {
+		s                  string
+		expUser, expDevice string
+		expErr             bool
+	}{
+		{"USERKEY", "USERKEY", "", false},
+		{"@alice", "ALICEKEY", "", false},
+		{"@phone", "BOBKEY", "iphone", false},
+		{"@empty", "", "", true},
+		{"@unknown", "", "", true},
+	}
+	for _, tt := range tests {
+		user, device, err := resolveUser(tt.s)
+		if (err != nil) != tt.expErr || user != tt.expUser || device != tt.expDevice {
+			t.Errorf("resolveUser(%q) = %q, %q, %v, expected %q, %q, error %v", tt.s, user, device, err, tt.expUser, tt.expDevice, tt.expErr)
+		}
+	}
+}
+
+func TestDedupCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	c, err := loadDedupCache(path, 3)
+	if err != nil {
+		t.Fatalf("loading missing cache: %v", err)
+	}
+	c.add("a")
+	c.add("b")
+	c.add("c")
+	// Makes "a" most recently used, so "b" is evicted next.
+	if !c.seen("a") {
+		t.Fatalf("a not seen")
+	}
+	c.add("d")
+	if c.seen("b") {
+		t.Errorf("b seen, expected evicted")
+	}
+	if err := c.save(); err != nil {
+		t.Fatalf("saving cache: %v", err)
+	}
+
+	c, err = loadDedupCache(path, 3)
+	if err != nil {
+		t.Fatalf("loading cache: %v", err)
+	}
+	if exp := []string{"c", "a", "d"}; !slices.Equal(c.hashes, exp) {
+		t.Errorf("loaded hashes %q, expected %q", c.hashes, exp)
+	}
+
+	data := validMessage()
+	h := messageHash(data)
+	data.Set("correlation_id", "0123456789abcdef")
+	if messageHash(data) != h {
+		t.Errorf("correlation id changes hash")
+	}
+	data.Set("message", "other")
+	if messageHash(data) == h {
+		t.Errorf("different messages have same hash")
+	}
+	if !data.Has("correlation_id") {
+		t.Errorf("messageHash modified data")
+	}
+}
+
+func TestSendMessageRetryAttachment(t *testing.T) {
+	att := &attachment{bytes.Repeat([]byte{0, 1, 2, 0xff}, 64*1024), "image/png"}
+	var attempts atomic.Int32
+	fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		n := attempts.Add(1)
+		if r.URL.Path != "/messages.json" {
+			t.Errorf("request for path %s", r.URL.Path)
+		}
+		if err := r.ParseMultipartForm(10 * 1024 * 1024); err != nil {
+			t.Errorf("attempt %d: parsing multipart form: %v", n, err)
+			return
+		}
+		f, fh, err := r.FormFile("attachment")
+		if err != nil {
+			t.Errorf("attempt %d: no attachment: %v", n, err)
+			return
+		}
+		buf, _ := io.ReadAll(f)
+		if !bytes.Equal(buf, att.Data) || fh.Header.Get("Content-Type") != att.Type {
+			t.Errorf("attempt %d: got attachment of %d bytes, type %q, expected %d bytes, type %q", n, len(buf), fh.Header.Get("Content-Type"), len(att.Data), att.Type)
+		}
+		if r.FormValue("message") != "hi" {
+			t.Errorf("attempt %d: message %q", n, r.FormValue("message"))
+		}
+		if n == 1 {
+			http.Error(w, "temporary failure", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Limit-App-Remaining", "9999")
+		fmt.Fprintln(w, `{"status":1,"request":"req2"}`)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := sendMessage(ctx, validMessage(), att, retryPolicy{Retries: 1})
+	if err != nil {
+		t.Fatalf("sending message: %v", err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("got %d attempts, expected 2", n)
+	}
+	if result.Request != "req2" || result.Remaining != 9999 {
+		t.Errorf("got result %+v", result)
+	}
+}
+
+func TestSendMessageNoRetryOn400(t *testing.T) {
+	var attempts atomic.Int32
+	fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, `{"token":"invalid","errors":["application token is invalid"],"status":0,"request":"req1"}`)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := sendMessage(ctx, validMessage(), nil, retryPolicy{Retries: 3})
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || !apiErr.invalidToken() {
+		t.Fatalf("got error %v, expected api error for invalid token", err)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("got %d attempts, expected 1", n)
+	}
+}
+
+func TestNewRequestGetBody(t *testing.T) {
+	body := bytes.Repeat([]byte("attachment"), 1000)
+	req, err := newRequest(context.Background(), http.MethodPost, "messages.json", "application/octet-stream", body, false)
+	if err != nil {
+		t.Fatalf("making request: %v", err)
+	}
+	if _, err := io.ReadAll(req.Body); err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	// After the body was sent, e.g. on a closed idle connection, the http client
+	// gets the body again.
+	for range 2 {
+		r, err := req.GetBody()
+		if err != nil {
+			t.Fatalf("get body: %v", err)
+		}
+		buf, _ := io.ReadAll(r)
+		if !bytes.Equal(buf, body) {
+			t.Fatalf("got body of %d bytes, expected %d", len(buf), len(body))
+		}
+	}
+	if req.ContentLength != int64(len(body)) {
+		t.Errorf("content length %d, expected %d", req.ContentLength, len(body))
+	}
+}
+
+func TestQuotaWait(t *testing.T) {
+	header := func(reset time.Time) http.Header {
+		h := http.Header{}
+		h.Set("X-Limit-App-Reset", fmt.Sprintf("%d", reset.Unix()))
+		return h
+	}
+	now := time.Now()
+
+	if _, err := quotaWait(http.Header{}, time.Hour, time.Time{}); err == nil {
+		t.Errorf("no error without reset time")
+	}
+	// Reset at start of next month is too far out for a short -max-wait.
+	if _, err := quotaWait(header(now.Add(20*24*time.Hour)), time.Minute, time.Time{}); err == nil || !strings.Contains(err.Error(), "beyond -max-wait") {
+		t.Errorf("got error %v, expected beyond -max-wait", err)
+	}
+	if _, err := quotaWait(header(now.Add(time.Hour)), 24*time.Hour, now.Add(time.Minute)); err == nil || !strings.Contains(err.Error(), "after -deadline") {
+		t.Errorf("got error %v, expected after -deadline", err)
+	}
+	d, err := quotaWait(header(now.Add(time.Hour)), 24*time.Hour, now.Add(2*time.Hour))
+	if err != nil || d < 59*time.Minute || d > time.Hour {
+		t.Errorf("got %s, %v, expected about an hour", d, err)
+	}
+	if d, err := quotaWait(header(now.Add(-time.Minute)), time.Hour, time.Time{}); err != nil || d != 0 {
+		t.Errorf("got %s, %v for reset in the past, expected 0", d, err)
+	}
+}
+
+func TestMessagesPath(t *testing.T) {
+	var paths []string
+	fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/relay/send":
+			fmt.Fprintln(w, `{"status":1,"request":"req1"}`)
+		case "/sounds.json":
+			fmt.Fprintln(w, `{"status":1,"sounds":{"pushover":"Pushover (default)"},"request":"req2"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	orig := messagesPath
+	messagesPath = "relay/send"
+	t.Cleanup(func() { messagesPath = orig })
+
+	ctx := context.Background()
+	if _, err := sendMessage(ctx, validMessage(), nil, retryPolicy{}); err != nil {
+		t.Fatalf("sending message: %v", err)
+	}
+	if _, err := fetchSounds(ctx, "token", "", false); err != nil {
+		t.Fatalf("fetching sounds: %v", err)
+	}
+	if exp := []string{"/relay/send", "/sounds.json"}; !slices.Equal(paths, exp) {
+		t.Errorf("got requests for %q, expected %q", paths, exp)
+	}
+}
+
+func TestServeMessages(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var got []listenRequest
+	handle := func(req listenRequest) (listenResponse, int) {
+		got = append(got, req)
+		return listenResponse{Request: "req1"}, http.StatusOK
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- serveMessages(addr, 0, handle)
+	}()
+
+	postHeaders := func(body string, h http.Header) (int, string) {
+		t.Helper()
+		var resp *http.Response
+		var err error
+		for range 50 {
+			req, _ := http.NewRequest("POST", "http://"+addr+"/", strings.NewReader(body))
+			req.Header = h
+			resp, err = http.DefaultClient.Do(req)
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		buf, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(buf))
+	}
+	post := func(body string) (int, string) {
+		t.Helper()
+		return postHeaders(body, http.Header{"Content-Type": {"application/json"}})
+	}
+
+	if status, body := post(`{"message":"disk full","title":"disk","priority":"high"}`); status != http.StatusOK || body != `{"request":"req1"}` {
+		t.Errorf("got %d %s", status, body)
+	}
+	if status, _ := post(`{"title":"no message"}`); status != http.StatusBadRequest {
+		t.Errorf("got status %d for missing message, expected 400", status)
+	}
+	if status, _ := post(`{"message":"x","token":"other"}`); status != http.StatusBadRequest {
+		t.Errorf("got status %d for unknown field, expected 400", status)
+	}
+	// Browsers can send simple cross-origin requests, without preflight, with
+	// content-type text/plain. And they send an Origin header.
+	if status, _ := postHeaders(`{"message":"x"}`, http.Header{"Content-Type": {"text/plain"}}); status != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d for text/plain, expected 415", status)
+	}
+	if status, _ := postHeaders(`{"message":"x"}`, http.Header{}); status != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d without content-type, expected 415", status)
+	}
+	if status, _ := postHeaders(`{"message":"x"}`, http.Header{"Content-Type": {"application/json; charset=utf-8"}, "Origin": {"https://example.com"}}); status != http.StatusForbidden {
+		t.Errorf("got status %d with origin, expected 403", status)
+	}
+	if status, _ := postHeaders(`{"message":"charset"}`, http.Header{"Content-Type": {"application/json; charset=utf-8"}}); status != http.StatusOK {
+		t.Errorf("got status %d for json with charset, expected 200", status)
+	}
+	if exp := []listenRequest{{Message: "disk full", Title: "disk", Priority: "high"}, {Message: "charset"}}; !slices.Equal(got, exp) {
+		t.Errorf("handled %+v, expected %+v", got, exp)
+	}
+
+	// Graceful shutdown on signal.
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("kill: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serving: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server did not shut down")
+	}
+}
+
+func TestSendMessageNoRetryAfterAccepted(t *testing.T) {
+	origStrict := strictJSON
+	t.Cleanup(func() { strictJSON = origStrict })
+
+	for _, strict := range []bool{false, true} {
+		strictJSON = strict
+		var attempts atomic.Int32
+		fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			if strict {
+				fmt.Fprintln(w, `{"status":1,"request":"req1","new_field":1}`)
+			} else {
+				fmt.Fprint(w, `{"status":1,"requ`)
+			}
+		})
+		_, err := sendMessage(context.Background(), validMessage(), nil, retryPolicy{Retries: 2})
+		if !errors.Is(err, errParseResponse) {
+			t.Errorf("strict %v: got error %v, expected errParseResponse", strict, err)
+		}
+		if n := attempts.Load(); n != 1 {
+			t.Errorf("strict %v: got %d attempts, expected 1, message was accepted", strict, n)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Tests of the command run the test binary with this environment variable
+	// set, see runCommand.
+	if os.Getenv("PUSHOVER_TEST_MAIN") != "" {
+		flag.CommandLine = flag.NewFlagSet("pushover", flag.ExitOnError)
+		os.Args[0] = "pushover"
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// apiServer is a fake pushover api for tests of the command, recording the
+// requests it handled.
+type apiServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []apiRequest
+}
+
+// apiRequest is a request handled by apiServer.
+type apiRequest struct {
+	Method      string
+	Path        string
+	ContentType string
+	Body        []byte
+	Form        url.Values // Query string and form, also from multipart.
+}
+
+// newAPIServer starts a fake api. Requests are first passed to fn if not nil,
+// which returns whether it handled the request. Other requests get a
+// successful response. Messages with highest priority get a receipt. User keys
+// starting with "g" are groups.
+func newAPIServer(t *testing.T, fn func(w http.ResponseWriter, r *http.Request) bool) *apiServer {
+	t.Helper()
+	s := &apiServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ParseMultipartForm(10 * 1024 * 1024)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		s.mu.Lock()
+		s.requests = append(s.requests, apiRequest{r.Method, r.URL.Path, r.Header.Get("Content-Type"), body, r.Form})
+		n := len(s.requests)
+		s.mu.Unlock()
+
+		if fn != nil && fn(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Limit-App-Limit", "10000")
+		w.Header().Set("X-Limit-App-Remaining", "9000")
+		w.Header().Set("X-Limit-App-Reset", "1893456000")
+		switch p := r.URL.Path; {
+		case p == "/messages.json":
+			if r.Form.Get("priority") == "2" {
+				fmt.Fprintf(w, `{"status":1,"request":"req%d","receipt":"rcpt%d"}`, n, n)
+			} else {
+				fmt.Fprintf(w, `{"status":1,"request":"req%d"}`, n)
+			}
+		case p == "/users/validate.json":
+			if strings.HasPrefix(r.Form.Get("user"), "g") {
+				fmt.Fprintf(w, `{"status":1,"group":1,"devices":[],"licenses":[],"request":"req%d"}`, n)
+			} else {
+				fmt.Fprintf(w, `{"status":1,"group":0,"devices":["iphone","pixel"],"licenses":["iOS"],"request":"req%d"}`, n)
+			}
+		case strings.HasPrefix(p, "/groups/"):
+			fmt.Fprintf(w, `{"status":1,"name":"ops","users":[{"user":"u1","device":"","memo":"","disabled":false}],"request":"req%d"}`, n)
+		case strings.HasPrefix(p, "/receipts/cancel_by_tag/"):
+			fmt.Fprintf(w, `{"status":1,"canceled":2,"request":"req%d"}`, n)
+		case strings.HasPrefix(p, "/receipts/"):
+			fmt.Fprintf(w, `{"status":1,"acknowledged":1,"acknowledged_at":1700000000,"acknowledged_by":"userkey","acknowledged_by_device":"iphone","last_delivered_at":1700000000,"expired":0,"expires_at":1893456000,"request":"req%d"}`, n)
+		case p == "/apps/limits.json":
+			fmt.Fprintf(w, `{"status":1,"limit":10000,"remaining":9000,"reset":1893456000,"request":"req%d"}`, n)
+		case p == "/sounds.json":
+			fmt.Fprintf(w, `{"status":1,"sounds":{"pushover":"Pushover (default)","siren":"Siren","custom1":"Custom"},"request":"req%d"}`, n)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// messages returns the requests for sending messages.
+func (s *apiServer) messages() []apiRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l []apiRequest
+	for _, r := range s.requests {
+		if r.Path == "/"+messagesPath {
+			l = append(l, r)
+		}
+	}
+	return l
+}
+
+// paths returns the paths of all requests.
+func (s *apiServer) paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l []string
+	for _, r := range s.requests {
+		l = append(l, r.Path)
+	}
+	return l
+}
+
+// cmdResult is the outcome of running the command.
+type cmdResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// testConfig is the config file used by runCommand.
+const testConfig = "AppToken: apptoken\nDestKey: userkey\n"
+
+// runCommand runs the command with args, with the config file testConfig and a
+// state directory in a temporary directory, and the api at srv. If srv is nil,
+// api calls fail.
+func runCommand(t *testing.T, srv *apiServer, args ...string) cmdResult {
+	t.Helper()
+	return runCommandConfig(t, srv, testConfig, "", args...)
+}
+
+// runCommandConfig is like runCommand, with a config file with content config,
+// and stdin.
+func runCommandConfig(t *testing.T, srv *apiServer, config, stdin string, args ...string) cmdResult {
+	t.Helper()
+	return runCommandEnv(t, srv, config, stdin, nil, args...)
+}
+
+// runCommandEnv is like runCommandConfig, with additional environment
+// variables env, as key=value.
+func runCommandEnv(t *testing.T, srv *apiServer, config, stdin string, env []string, args ...string) cmdResult {
+	t.Helper()
+	cmd := newCommand(t, srv, config, env, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("running command: %v", err)
+	}
+	return cmdResult{stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()}
+}
+
+// newCommand returns the command with args, set up like runCommandEnv, for
+// tests that need to interact with the running command.
+func newCommand(t *testing.T, srv *apiServer, config string, env []string, args ...string) *exec.Cmd {
+	t.Helper()
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "pushover.conf")
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	base := "http://127.0.0.1:1/"
+	if srv != nil {
+		base = srv.URL + "/"
+	}
+	cmd := exec.Command(os.Args[0], append([]string{"-configpath", configPath, "-state-dir", filepath.Join(dir, "state"), "-api-base", base}, args...)...)
+	cmd.Env = append([]string{"PUSHOVER_TEST_MAIN=1", "HOME=" + dir, "TZ=UTC"}, env...)
+	return cmd
+}
+
+func TestDedupCacheSize(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	for _, size := range []string{"-1", "0"} {
+		r := runCommand(t, srv, "-dedup", "-dedup-cache-size", size, "hi")
+		if r.ExitCode != 2 || !strings.Contains(r.Stderr, "-dedup-cache-size must be at least 1") {
+			t.Errorf("size %s: got exit code %d, stderr %q", size, r.ExitCode, r.Stderr)
+		}
+	}
+	if n := len(srv.messages()); n != 0 {
+		t.Errorf("sent %d messages, expected none", n)
+	}
+}
+
+func TestDedupCommand(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	state := t.TempDir()
+	for range 2 {
+		if r := runCommand(t, srv, "-state-dir", state, "-dedup", "-dedup-cache-size", "1", "hi"); r.ExitCode != 0 {
+			t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+		}
+	}
+	r := runCommand(t, srv, "-state-dir", state, "-dedup", "-dedup-cache-size", "1", "other")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 2 {
+		t.Errorf("sent %d messages, expected 2", n)
+	}
+}
+
+func TestVerboseValidateFails(t *testing.T) {
+	// A relay that does not implement validating users.
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/users/validate.json" {
+			http.NotFound(w, r)
+			return true
+		}
+		return false
+	})
+	r := runCommand(t, srv, "-verbose", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "warning: validating user for -verbose") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("sent %d messages, expected 1", n)
+	}
+
+	// Needed for -verify-device, so fatal.
+	r = runCommand(t, srv, "-verify-device", "-device", "iphone", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "validating user:") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("sent %d messages, expected 1", n)
+	}
+}
+
+func TestAckListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	l, err := listenAck(addr)
+	if err != nil {
+		t.Fatalf("listening for acknowledgements: %v", err)
+	}
+	defer l.close()
+
+	post := func(form url.Values) int {
+		t.Helper()
+		resp, err := http.PostForm("http://"+addr+"/ack", form)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(url.Values{"receipt": {"rcpt1"}}); status != http.StatusBadRequest {
+		t.Errorf("got status %d without acknowledged, expected 400", status)
+	}
+	ack := url.Values{"receipt": {"rcpt1"}, "acknowledged": {"1"}, "acknowledged_at": {"1700000000"}, "acknowledged_by": {"userkey"}, "acknowledged_by_device": {"iphone"}}
+	if status := post(ack); status != http.StatusOK {
+		t.Errorf("got status %d for acknowledgement, expected 200", status)
+	}
+
+	var out bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.wait(ctx, []string{"rcpt1"}, &out); err != nil {
+		t.Fatalf("waiting: %v", err)
+	}
+	if !strings.Contains(out.String(), "receipt rcpt1: acknowledged at ") || !strings.Contains(out.String(), "by userkey (device iphone)") {
+		t.Errorf("got output %q", out.String())
+	}
+
+	// Times out when not acknowledged.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, []string{"rcpt2"}, &out); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, expected deadline exceeded", err)
+	}
+}
+
+func TestWaitAckOutput(t *testing.T) {
+	srv := newAPIServer(t, nil)
+
+	r := runCommand(t, srv, "-priority", "highest", "-wait-ack", "-json", "hi")
+	var results []sendResult
+	if err := json.Unmarshal([]byte(r.Stdout), &results); r.ExitCode != 0 || err != nil || len(results) != 1 || results[0].Request != "req1" {
+		t.Errorf("got exit code %d, results %v, error %v, stdout %q", r.ExitCode, results, err, r.Stdout)
+	}
+	if !strings.Contains(r.Stderr, "receipt rcpt1: acknowledged at") {
+		t.Errorf("no acknowledgement in stderr %q", r.Stderr)
+	}
+
+	r = runCommand(t, srv, "-priority", "highest", "-wait-ack", "-print-request-id", "hi")
+	if r.ExitCode != 0 || r.Stdout != "req3\n" || !strings.Contains(r.Stderr, "receipt rcpt3: acknowledged at") {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+
+	// Without structured output, outcomes are printed to stdout.
+	r = runCommand(t, srv, "-priority", "highest", "-wait-ack", "hi")
+	if r.ExitCode != 0 || !strings.HasPrefix(r.Stdout, "receipt rcpt5: acknowledged at") {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+}
+
+func TestBodyBase64(t *testing.T) {
+	srv := newAPIServer(t, nil)
+
+	msg := "line 1\n\n\n\"quoted\" $HOME `x`\t\tend"
+	r := runCommand(t, srv, "-body-base64", base64.StdEncoding.EncodeToString([]byte(msg)))
+	if l := srv.messages(); r.ExitCode != 0 || len(l) != 1 || l[0].Form.Get("message") != msg {
+		t.Fatalf("got exit code %d, stderr %q, messages %v", r.ExitCode, r.Stderr, l)
+	}
+
+	if r := runCommand(t, srv, "-body-base64", "not base64!"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "decoding -body-base64") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-body-base64", base64.StdEncoding.EncodeToString([]byte{0xff, 0xfe})); r.ExitCode != 2 || !strings.Contains(r.Stderr, "not valid utf-8") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+
+	// The length is checked after -collapse-whitespace.
+	long := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("trace line\n\n\n\n", 80)))
+	if r := runCommand(t, srv, "-body-base64", long); r.ExitCode != 1 || !strings.Contains(r.Stderr, "message is 1120 characters, maximum is 1024") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-collapse-whitespace", "-body-base64", long); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 2 {
+		t.Errorf("sent %d messages, expected 2", n)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, "temporary failure", http.StatusServiceUnavailable)
+		return true
+	})
+	r := runCommand(t, srv, "-max-attempts", "3", "hi")
+	if r.ExitCode != 1 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 3 {
+		t.Errorf("got %d attempts, expected 3", n)
+	}
+
+	for _, args := range [][]string{{"-retries", "0", "-max-attempts", "3"}, {"-max-attempts", "3", "-retries", "2"}} {
+		r := runCommand(t, srv, append(args, "hi")...)
+		if r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine -retries and -max-attempts") {
+			t.Errorf("%v: got exit code %d, stderr %q", args, r.ExitCode, r.Stderr)
+		}
+	}
+	if r := runCommand(t, srv, "-max-attempts", "-1", "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "-max-attempts must be at least 1") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 3 {
+		t.Errorf("got %d attempts, expected 3", n)
+	}
+}
+
+func TestPrintRequestID(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-print-request-id", "-verbose", "hi")
+	if r.ExitCode != 0 || r.Stdout != "req2\n" {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+}
+
+func TestConfigPriority(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := testConfig + "Priority: high\n"
+	if r := runCommandConfig(t, srv, config, "", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// The flag overrides the config.
+	if r := runCommandConfig(t, srv, config, "", "-priority", "low", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("priority") != "1" || l[1].Form.Get("priority") != "-1" {
+		t.Errorf("got messages %v", l)
+	}
+
+	r := runCommandConfig(t, srv, testConfig+"Priority: urgent\n", "", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "parsing Priority in config file") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestTags(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	if r := runCommand(t, srv, "-priority", "highest", "-tags", "db, disk", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("tags") != "db,disk" {
+		t.Errorf("got messages %v", l)
+	}
+	if r := runCommand(t, srv, "-tags", "db,,disk", "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "empty tag") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+
+	r := runCommand(t, srv, "-cancel-by-tag", "db")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "canceled 2 notifications") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if p := srv.paths(); len(p) != 2 || p[1] != "/receipts/cancel_by_tag/db.json" {
+		t.Errorf("got paths %v", p)
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":0,"errors":["message cannot be blank"],"request":"req1"}`)
+		return true
+	})
+	if r := runCommand(t, srv, "hi"); r.ExitCode != 1 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	r := runCommand(t, srv, "-fail-open", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "sending message: ") || !strings.Contains(r.Stderr, "message cannot be blank") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestRetryExpireOnlyHighest(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-priority", "high", "-retry", "60", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "warning: -retry is only used for highest priority notifications") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-priority", "highest", "-retry", "60", "hi"); r.ExitCode != 0 || r.Stderr != "" {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 {
+		t.Fatalf("got messages %v", l)
+	}
+	if l[0].Form.Has("retry") || l[0].Form.Has("expire") {
+		t.Errorf("got retry/expire for priority 1: %v", l[0].Form)
+	}
+	if l[1].Form.Get("retry") != "60" || l[1].Form.Get("expire") != "3600" {
+		t.Errorf("got form %v for priority 2", l[1].Form)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-trace", "hi")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	for _, s := range []string{"trace: 0s: getting connection for 127.0.0.1:", "connected to tcp 127.0.0.1:", "wrote request, err <nil>", "got first response byte"} {
+		if !strings.Contains(r.Stderr, s) {
+			t.Errorf("missing %q in stderr %q", s, r.Stderr)
+		}
+	}
+	if r := runCommand(t, srv, "hi"); strings.Contains(r.Stderr, "trace:") {
+		t.Errorf("got trace without -trace, stderr %q", r.Stderr)
+	}
+}
+
+func TestSaveConfig(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	path := filepath.Join(t.TempDir(), "saved.conf")
+	r := runCommand(t, srv, "-save-config", path, "-user", "otheruser", "-title", "backups", "-priority", "high", "-retry", "60")
+	if r.ExitCode != 0 || r.Stderr != "" {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 0 {
+		t.Errorf("sent %d messages, expected none", n)
+	}
+
+	saved := config
+	if err := sconf.ParseFile(path, &saved); err != nil {
+		t.Fatalf("parsing saved config: %v", err)
+	}
+	if saved.AppToken != "apptoken" || saved.DestKey != "otheruser" || saved.Title != "backups" || saved.Priority != "high" || saved.Retry != 60 {
+		t.Errorf("got saved config %#v", saved)
+	}
+
+	// The saved config works as config file.
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading saved config: %v", err)
+	}
+	if r := runCommandConfig(t, srv, string(buf), "", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("user") != "otheruser" || l[0].Form.Get("title") != "backups" || l[0].Form.Get("priority") != "1" {
+		t.Errorf("got messages %v", l)
+	}
+
+	// Existing files keep their permissions, which are warned about.
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if r := runCommand(t, srv, "-save-config", path); r.ExitCode != 0 || !strings.Contains(r.Stderr, "accessible by others") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	// Stdin of the command is not a terminal.
+	r := runCommandConfig(t, srv, testConfig, "y\n", "-confirm", "-priority", "highest", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "stdin is not a terminal") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 0 {
+		t.Errorf("sent %d messages, expected none", n)
+	}
+	if r := runCommand(t, srv, "-confirm", "-force", "-priority", "highest", "hi"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// Only for highest priority.
+	if r := runCommand(t, srv, "-confirm", "hi"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 2 {
+		t.Errorf("sent %d messages, expected 2", n)
+	}
+
+	confirmed := func(input string) bool {
+		t.Helper()
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("pipe: %v", err)
+		}
+		defer pr.Close()
+		pw.WriteString(input)
+		pw.Close()
+		devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		defer devnull.Close()
+		origStdin, origStderr := os.Stdin, os.Stderr
+		os.Stdin, os.Stderr = pr, devnull
+		defer func() {
+			os.Stdin, os.Stderr = origStdin, origStderr
+		}()
+		return askConfirm("send?")
+	}
+	for input, exp := range map[string]bool{"n\n": false, "\n": false, "": false, "yes\n": false, "y\n": true} {
+		if got := confirmed(input); got != exp {
+			t.Errorf("input %q: got %v, expected %v", input, got, exp)
+		}
+	}
+}
+
+func TestRepeatedMessage(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-json", "-message", "disk full", "-message", "backup failed")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("message") != "disk full" || l[1].Form.Get("message") != "backup failed" {
+		t.Errorf("got messages %v", l)
+	}
+	var results []sendResult
+	if err := json.Unmarshal([]byte(r.Stdout), &results); err != nil || len(results) != 2 {
+		t.Errorf("got results %v, error %v", results, err)
+	}
+	if r := runCommand(t, srv, "-message", "a", "b"); r.ExitCode != 2 {
+		t.Errorf("got exit code %d for -message with arguments, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestRetryOnRateLimit(t *testing.T) {
+	var limited atomic.Bool
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/messages.json" || !limited.CompareAndSwap(false, true) {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Limit-App-Remaining", "0")
+		w.Header().Set("X-Limit-App-Reset", fmt.Sprintf("%d", time.Now().Add(time.Second).Unix()))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"status":0,"errors":["message limit reached"],"request":"req1"}`)
+		return true
+	})
+
+	r := runCommand(t, srv, "-retries", "0", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "message quota exhausted until ") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+
+	limited.Store(false)
+	r = runCommand(t, srv, "-retries", "0", "-retry-on-rate-limit", "-print-request-id", "hi")
+	if r.ExitCode != 0 || r.Stdout != "req3\n" || !strings.Contains(r.Stderr, "message quota exhausted, waiting until reset") {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+
+	// Not waiting for a reset beyond the timeout.
+	limited.Store(false)
+	r = runCommand(t, srv, "-retries", "0", "-retry-on-rate-limit", "-timeout", "100ms", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "message quota exhausted until ") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestVerifyDevice(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-verify-device", "-device", "ipohne", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, `user does not have device "ipohne", devices: iphone, pixel`) {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 0 {
+		t.Errorf("sent %d messages, expected none", n)
+	}
+	if r := runCommand(t, srv, "-verify-device", "-device", "pixel", "hi"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("device") != "pixel" {
+		t.Errorf("got messages %v", l)
+	}
+}
+
+func TestTemplateFile(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	path := filepath.Join(t.TempDir(), "alert.tmpl")
+	if err := os.WriteFile(path, []byte("{{.service}} on {{.host}} is down\n"), 0600); err != nil {
+		t.Fatalf("writing template: %v", err)
+	}
+	r := runCommand(t, srv, "-template-file", path, "-var", "service=nginx", "-var", "host=web1")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("message") != "nginx on web1 is down" {
+		t.Errorf("got messages %v", l)
+	}
+
+	if r := runCommand(t, srv, "-template-file", path, "-var", "service=nginx"); r.ExitCode != 1 || !strings.Contains(r.Stderr, `map has no entry for key "host"`) {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// The length limit applies to the rendered message.
+	long := strings.Repeat("x", 1010)
+	if r := runCommand(t, srv, "-template-file", path, "-var", "service="+long, "-var", "host=web1"); r.ExitCode != 1 || !strings.Contains(r.Stderr, "message is 1026 characters, maximum is 1024") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("sent %d messages, expected 1", n)
+	}
+}
+
+func TestEmphasisLink(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-emphasis", "-link", "https://example.org/a?b=1&c=2 build <42>", "tests failed & more")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	exp := "<b>tests failed &amp; more</b>\n" + `<a href="https://example.org/a?b=1&amp;c=2">build &lt;42&gt;</a>`
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("message") != exp || l[0].Form.Get("html") != "1" {
+		t.Errorf("got messages %v", l)
+	}
+
+	if r := runCommand(t, srv, "-emphasis", "-monospace", "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine html") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestBatchStdin(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommandConfig(t, srv, testConfig, "disk full\n\nload high\n  \nswap used\n", "-batch-stdin", "-interval", "0")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	var got []string
+	for _, m := range srv.messages() {
+		got = append(got, m.Form.Get("message"))
+	}
+	if exp := []string{"disk full", "load high", "swap used"}; !slices.Equal(got, exp) {
+		t.Errorf("got messages %q, expected %q", got, exp)
+	}
+
+	// With coalesce, lines read within the interval are combined.
+	var sent []string
+	batchLines(strings.NewReader("a\nb\n\nc\n"), time.Second, true, func(msg string) {
+		sent = append(sent, msg)
+	})
+	if exp := []string{"a\nb\nc"}; !slices.Equal(sent, exp) {
+		t.Errorf("got coalesced messages %q, expected %q", sent, exp)
+	}
+}
+
+func TestNewTransportHTTP1(t *testing.T) {
+	tr := newTransport(true, time.Minute)
+	if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+		t.Errorf("got ForceAttemptHTTP2 %v, TLSNextProto %v, expected http/1.1 only", tr.ForceAttemptHTTP2, tr.TLSNextProto)
+	}
+	tr = newTransport(false, time.Minute)
+	if !tr.ForceAttemptHTTP2 || tr.TLSNextProto != nil {
+		t.Errorf("got ForceAttemptHTTP2 %v, TLSNextProto %v, expected default", tr.ForceAttemptHTTP2, tr.TLSNextProto)
+	}
+}
+
+func TestNewTransportIdleTimeout(t *testing.T) {
+	if tr := newTransport(false, 5*time.Second); tr.IdleConnTimeout != 5*time.Second {
+		t.Errorf("got idle timeout %s, expected 5s", tr.IdleConnTimeout)
+	}
+	if tr := newTransport(true, 0); tr.IdleConnTimeout != 0 {
+		t.Errorf("got idle timeout %s, expected 0", tr.IdleConnTimeout)
+	}
+}
+
+func TestBatchJSONTime(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	start := time.Now()
+	r := runCommandConfig(t, srv, testConfig, "one\ntwo\n", "-batch-stdin", "-interval", "0", "-json")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	var results []map[string]any
+	if err := json.Unmarshal([]byte(r.Stdout), &results); err != nil || len(results) != 2 {
+		t.Fatalf("got results %v, error %v, stdout %q", results, err, r.Stdout)
+	}
+	for _, res := range results {
+		s, _ := res["time"].(string)
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil || tm.Before(start.Add(-time.Second)) || tm.After(time.Now()) {
+			t.Errorf("got time %q, error %v", s, err)
+		}
+	}
+}
+
+func TestNoTitle(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := testConfig + "Title: backups\n"
+	if r := runCommandConfig(t, srv, config, "", "-no-title", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommandConfig(t, srv, config, "", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Has("title") || l[1].Form.Get("title") != "backups" {
+		t.Errorf("got messages %v", l)
+	}
+	if r := runCommandConfig(t, srv, config, "", "-no-title", "-title", "x", "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine -title and -no-title") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestPrioritySound(t *testing.T) {
+	for p, exp := range map[int]string{2: "siren", 1: "tugboat", 0: "pushover", -1: "none", -2: "none"} {
+		if got := prioritySound(p); got != exp {
+			t.Errorf("priority %d: got %q, expected %q", p, got, exp)
+		}
+	}
+
+	// An explicit -sound takes precedence.
+	srv := newAPIServer(t, nil)
+	for _, args := range [][]string{{"-priority", "highest"}, {"-priority", "low"}, {"-priority", "highest", "-sound", "custom1"}} {
+		if r := runCommand(t, srv, append(append([]string{"-sound-by-priority"}, args...), "hi")...); r.ExitCode != 0 {
+			t.Fatalf("%v: got exit code %d, stderr %q", args, r.ExitCode, r.Stderr)
+		}
+	}
+	var got []string
+	for _, m := range srv.messages() {
+		got = append(got, m.Form.Get("sound"))
+	}
+	if exp := []string{"siren", "none", "custom1"}; !slices.Equal(got, exp) {
+		t.Errorf("got sounds %q, expected %q", got, exp)
+	}
+}
+
+func TestDumpCurl(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-dump-curl", "-no-send", "-title", "it's", "hi")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	exp := fmt.Sprintf(`curl -X POST '%s/messages.json' --data-urlencode 'message=hi' --data-urlencode 'title=it'\''s' --data-urlencode 'token=REDACTED' --data-urlencode 'user=userkey'`, srv.URL)
+	if !strings.Contains(r.Stderr, exp+"\n") || strings.Contains(r.Stderr, "apptoken") {
+		t.Errorf("got stderr %q, expected %q", r.Stderr, exp)
+	}
+	if n := len(srv.messages()); n != 0 {
+		t.Errorf("sent %d messages with -no-send, expected none", n)
+	}
+
+	r = runCommandConfig(t, srv, testConfig, "GIF89a", "-dump-curl", "-no-send", "-stdin-attachment", "-attachment-type", "image/gif", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "--form-string 'token=REDACTED'") || !strings.Contains(r.Stderr, "-F 'attachment=@-;type=image/gif'") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("loading location: %v", err)
+	}
+	orig := location
+	defer func() {
+		location = orig
+	}()
+	tm := time.Unix(1700000000, 0)
+	location = time.UTC
+	if s := formatTime(tm); s != "2023-11-14T22:13:20Z" {
+		t.Errorf("got %q for utc", s)
+	}
+	location = ny
+	if s := formatTime(tm); s != "2023-11-14T17:13:20-05:00" {
+		t.Errorf("got %q for america/new_york", s)
+	}
+
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-tz", "America/New_York", "-priority", "highest", "-wait-ack", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stdout, "acknowledged at 2023-11-14T17:13:20-05:00") {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-tz", "Nowhere/Special", "hi"); r.ExitCode != 1 || !strings.Contains(r.Stderr, "loading time zone") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestStdinAttachment(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	var imgBuf bytes.Buffer
+	if err := pngEncode(&imgBuf); err != nil {
+		t.Fatalf("encoding png: %v", err)
+	}
+	r := runCommandConfig(t, srv, testConfig, imgBuf.String(), "-stdin-attachment", "-attachment-type", "image/png", "graph")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 1 {
+		t.Fatalf("got messages %v", l)
+	}
+	_, params, err := mime.ParseMediaType(l[0].ContentType)
+	if err != nil {
+		t.Fatalf("parsing content-type %q: %v", l[0].ContentType, err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(l[0].Body), params["boundary"])
+	var found bool
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("reading part: %v", err)
+		}
+		if p.FormName() != "attachment" {
+			continue
+		}
+		found = true
+		buf, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Type") != "image/png" || !bytes.Equal(buf, imgBuf.Bytes()) {
+			t.Errorf("got attachment of type %q, %d bytes, expected image/png, %d bytes", p.Header.Get("Content-Type"), len(buf), imgBuf.Len())
+		}
+	}
+	if !found || l[0].Form.Get("message") != "graph" {
+		t.Errorf("got attachment %v, form %v", found, l[0].Form)
+	}
+
+	big := strings.Repeat("x", maxAttachmentSize+1)
+	if r := runCommandConfig(t, srv, testConfig, big, "-stdin-attachment", "-attachment-type", "image/png", "graph"); r.ExitCode != 1 || !strings.Contains(r.Stderr, "attachment larger than maximum") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-stdin-attachment", "graph"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "requires -attachment-type") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("sent %d messages, expected 1", n)
+	}
+}
+
+// pngEncode writes a small png image to w.
+func pngEncode(w io.Writer) error {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.RGBA{255, 0, 0, 255})
+	return png.Encode(w, img)
+}
+
+func TestTruncateTitle(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	long := strings.Repeat("é", 251)
+	r := runCommand(t, srv, "-title", long, "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "title is 251 characters, maximum is 250") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-truncate-title", "-title", long, "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	exp := strings.Repeat("é", 249) + "…"
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("title") != exp {
+		t.Errorf("got messages %v", l)
+	}
+
+	if s := truncate("abc", 3); s != "abc" {
+		t.Errorf("got %q, expected abc", s)
+	}
+	if s := truncate("abcd", 3); s != "ab…" {
+		t.Errorf("got %q, expected ab…", s)
+	}
+}
+
+func TestDumpHeaders(t *testing.T) {
+	var fail atomic.Bool
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if !fail.Load() {
+			return false
+		}
+		w.Header().Set("X-Request-Id", "abc")
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return true
+	})
+	r := runCommand(t, srv, "-dump-headers", "hi")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	exp := "HTTP/1.1 200 OK\nContent-Length: 29\nContent-Type: application/json\nDate: "
+	if !strings.HasPrefix(r.Stderr, exp) || !strings.Contains(r.Stderr, "\nX-Limit-App-Limit: 10000\nX-Limit-App-Remaining: 9000\nX-Limit-App-Reset: 1893456000\n") {
+		t.Errorf("got stderr %q", r.Stderr)
+	}
+
+	// Also for failed requests.
+	fail.Store(true)
+	r = runCommand(t, srv, "-dump-headers", "-retries", "0", "hi")
+	if r.ExitCode != 1 || !strings.HasPrefix(r.Stderr, "HTTP/1.1 502 Bad Gateway\n") || !strings.Contains(r.Stderr, "\nX-Request-Id: abc\n") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestSendIfFile(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	dir := t.TempDir()
+	exists := filepath.Join(dir, "alert.flag")
+	if err := os.WriteFile(exists, nil, 0600); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	missing := filepath.Join(dir, "missing.flag")
+
+	r := runCommand(t, srv, "-send-if-file-exists", missing, "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "not sending, "+missing+" does not exist") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	r = runCommand(t, srv, "-send-if-file-missing", exists, "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "not sending, "+exists+" exists") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 0 {
+		t.Fatalf("sent %d messages, expected none", n)
+	}
+
+	if r := runCommand(t, srv, "-send-if-file-exists", exists, "hi"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-send-if-file-missing", missing, "hi"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 2 {
+		t.Errorf("sent %d messages, expected 2", n)
+	}
+}
+
+func TestPriorityEnv(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	env := []string{"PUSHOVER_PRIORITY=high"}
+	if r := runCommandEnv(t, srv, testConfig, "", env, "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// The flag overrides the environment, the environment overrides the config.
+	if r := runCommandEnv(t, srv, testConfig, "", env, "-priority", "lowest", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommandEnv(t, srv, testConfig+"Priority: low\n", "", env, "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	var got []string
+	for _, m := range srv.messages() {
+		got = append(got, m.Form.Get("priority"))
+	}
+	if exp := []string{"1", "-2", "1"}; !slices.Equal(got, exp) {
+		t.Errorf("got priorities %q, expected %q", got, exp)
+	}
+
+	r := runCommandEnv(t, srv, testConfig, "", []string{"PUSHOVER_PRIORITY=loud"}, "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "parsing environment variable PUSHOVER_PRIORITY") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestDebugConfig(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := testConfig + "Title: from config\nPriority: low\n"
+	r := runCommandConfig(t, srv, config, "", "-debug-config", "-title", "from flag", "-device", "pixel")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// In the order of the config file.
+	last := -1
+	for _, s := range []string{"AppToken: REDACTED\n", "DestKey: userkey\n", "Device: pixel\n", "Title: from flag\n", "Priority: low\n"} {
+		i := strings.Index(r.Stdout, s)
+		if i <= last {
+			t.Errorf("missing or out of order %q in stdout %q", s, r.Stdout)
+		}
+		last = i
+	}
+	if strings.Contains(r.Stdout, "apptoken") {
+		t.Errorf("app token not redacted in stdout %q", r.Stdout)
+	}
+	if n := len(srv.messages()); n != 0 {
+		t.Errorf("sent %d messages, expected none", n)
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls []int64
+	r := &progressReader{ctx: ctx, r: bytes.NewReader(make([]byte, 25)), fn: func(n int64) {
+		calls = append(calls, n)
+	}}
+	buf := make([]byte, 10)
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	if exp := []int64{10, 20, 25}; !slices.Equal(calls, exp) {
+		t.Errorf("got progress %v, expected %v", calls, exp)
+	}
+
+	// Reads fail after cancel.
+	r = &progressReader{ctx: ctx, r: bytes.NewReader(make([]byte, 25)), fn: func(n int64) {}}
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	cancel()
+	if _, err := r.Read(buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v after cancel, expected context canceled", err)
+	}
+}
+
+func TestOutputTemplate(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	tmpl := "id={{.RequestID}} receipt={{.Receipt}} remaining={{.Remaining}}{{if .Error}} error={{.Error}}{{end}}"
+	r := runCommand(t, srv, "-output-template", tmpl, "-priority", "highest", "hi")
+	if r.ExitCode != 0 || r.Stdout != "id=req1 receipt=rcpt1 remaining=9000\n" {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+
+	fail := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":0,"errors":["user identifier is invalid"],"request":"req1"}`)
+		return true
+	})
+	r = runCommand(t, fail, "-output-template", tmpl, "hi")
+	if r.ExitCode != 1 || !strings.HasPrefix(r.Stdout, "id= receipt= remaining=-1 error=") || !strings.Contains(r.Stdout, "user identifier is invalid") {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+
+	if r := runCommand(t, srv, "-output-template", "{{.Bogus", "hi"); r.ExitCode != 1 || !strings.Contains(r.Stderr, "parsing output template") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestNoSend(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	state := t.TempDir()
+	r := runCommand(t, srv, "-state-dir", state, "-no-send", "-dedup", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "not sending message due to -no-send") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if p := srv.paths(); len(p) != 0 {
+		t.Fatalf("got requests %v, expected none", p)
+	}
+	// State for -dedup was updated.
+	if _, err := os.Stat(filepath.Join(state, "dedup")); err != nil {
+		t.Errorf("stat dedup state: %v", err)
+	}
+	r = runCommand(t, srv, "-state-dir", state, "-dedup", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "not sending duplicate of recently sent message") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if p := srv.paths(); len(p) != 0 {
+		t.Errorf("got requests %v, expected none", p)
+	}
+}
+
+func TestReadErrorBody(t *testing.T) {
+	response := func(h http.Header, body []byte) *http.Response {
+		return &http.Response{Header: h, Body: io.NopCloser(bytes.NewReader(body))}
+	}
+
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write([]byte(`{"status":0,"errors":["application token is invalid"]}`))
+	gzw.Close()
+	h := http.Header{"Content-Encoding": {"gzip"}, "Content-Type": {"application/json"}}
+	buf, err := readErrorBody(response(h, gz.Bytes()))
+	if err != nil || string(buf) != `{"status":0,"errors":["application token is invalid"]}` {
+		t.Errorf("got %q, %v", buf, err)
+	}
+	if _, err := readErrorBody(response(h, []byte("not gzip"))); err == nil {
+		t.Errorf("no error for invalid gzip body")
+	}
+
+	h = http.Header{"Content-Type": {"text/plain; charset=ISO-8859-1"}}
+	buf, err = readErrorBody(response(h, []byte("D\xe9faillance du service")))
+	if err != nil || string(buf) != "Défaillance du service" {
+		t.Errorf("got %q, %v", buf, err)
+	}
+
+	// Only the start of the body is read.
+	buf, err = readErrorBody(response(http.Header{}, bytes.Repeat([]byte("x"), 2000)))
+	if err != nil || len(buf) != 1024 {
+		t.Errorf("got %d bytes, %v, expected 1024", len(buf), err)
+	}
+
+	// The decompressed body is shown in errors of api calls.
+	fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(gz.Bytes())
+	})
+	err = apiPost(context.Background(), "messages.json", url.Values{}, &messageResult{})
+	if err == nil || !strings.Contains(err.Error(), `application token is invalid`) {
+		t.Errorf("got error %v, expected decompressed body", err)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	state := t.TempDir()
+	run := func(cooldown, title, msg string) cmdResult {
+		t.Helper()
+		r := runCommand(t, srv, "-state-dir", state, "-cooldown", cooldown, "-title", title, msg)
+		if r.ExitCode != 0 {
+			t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+		}
+		return r
+	}
+	run("1h", "disk", "disk 90% full")
+	// Skipped regardless of content.
+	if r := run("1h", "disk", "disk 95% full"); !strings.Contains(r.Stderr, "within cooldown") {
+		t.Errorf("got stderr %q, expected skip within cooldown", r.Stderr)
+	}
+	// Other titles have their own cooldown.
+	run("1h", "load", "load high")
+	// After the cooldown, messages are sent again.
+	run("1ms", "disk", "disk 99% full")
+
+	var got []string
+	for _, m := range srv.messages() {
+		got = append(got, m.Form.Get("message"))
+	}
+	if exp := []string{"disk 90% full", "load high", "disk 99% full"}; !slices.Equal(got, exp) {
+		t.Errorf("got messages %q, expected %q", got, exp)
+	}
+}
+
+func TestAttachmentResize(t *testing.T) {
+	// Noise does not compress, making a png above the maximum size.
+	img := image.NewRGBA(image.Rect(0, 0, 1600, 900))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = byte(seed >> 24)
+	}
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&buf, img); err != nil {
+		t.Fatalf("encoding png: %v", err)
+	}
+	if buf.Len() <= maxAttachmentSize {
+		t.Fatalf("png is %d bytes, expected above maximum", buf.Len())
+	}
+
+	if _, err := readAttachment(bytes.NewReader(buf.Bytes()), "image/png", false); err == nil {
+		t.Errorf("no error for oversized attachment without resize")
+	}
+	att, err := readAttachment(bytes.NewReader(buf.Bytes()), "image/png", true)
+	if err != nil {
+		t.Fatalf("reading attachment with resize: %v", err)
+	}
+	if len(att.Data) > maxAttachmentSize || att.Type != "image/jpeg" {
+		t.Errorf("got attachment of %d bytes, type %q", len(att.Data), att.Type)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(att.Data))
+	if err != nil {
+		t.Fatalf("decoding resized image: %v", err)
+	}
+	// Aspect ratio is kept.
+	if cfg.Width >= 1600 || math.Abs(float64(cfg.Width)/float64(cfg.Height)-16.0/9) > 0.01 {
+		t.Errorf("got resized image %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-healthcheck")
+	exp := "PASS connectivity\nPASS app token and user key: this is a user key with 2 devices\nPASS message quota: 9000 of 10000 remaining, resets at 2030-01-01T00:00:00Z\n"
+	if r.ExitCode != 0 || r.Stdout != exp {
+		t.Errorf("got exit code %d, stdout %q, expected %q", r.ExitCode, r.Stdout, exp)
+	}
+
+	exhausted := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/apps/limits.json" {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":1,"limit":10000,"remaining":0,"reset":1893456000,"request":"req1"}`)
+		return true
+	})
+	r = runCommand(t, exhausted, "-healthcheck")
+	if r.ExitCode != 1 || !strings.Contains(r.Stdout, "PASS app token and user key") || !strings.Contains(r.Stdout, "FAIL message quota: message quota exhausted, 0 of 10000 remaining") {
+		t.Errorf("got exit code %d, stdout %q", r.ExitCode, r.Stdout)
+	}
+
+	// Without connectivity, other checks are skipped.
+	r = runCommand(t, nil, "-healthcheck")
+	if r.ExitCode != 1 || !strings.HasPrefix(r.Stdout, "FAIL connectivity: ") || strings.Count(r.Stdout, "\n") != 1 {
+		t.Errorf("got exit code %d, stdout %q", r.ExitCode, r.Stdout)
+	}
+}
+
+func TestSilent(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	if r := runCommand(t, srv, "-silent", "hi"); r.ExitCode != 0 || r.Stderr != "" {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	r := runCommand(t, srv, "-silent", "-priority", "highest", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "warning: -silent does not silence highest priority notifications") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("sound") != "none" || l[1].Form.Get("sound") != "none" {
+		t.Errorf("got messages %v", l)
+	}
+	if r := runCommand(t, srv, "-silent", "-sound", "siren", "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine -silent and -sound") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"token":"invalid","errors":["application token is invalid"],"status":0,"request":"req1"}`)
+		return true
+	})
+	r := runCommand(t, srv, "hi")
+	if r.ExitCode != exitInvalidToken || !strings.Contains(r.Stderr, "application token is invalid, check AppToken in config file") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// Not retried.
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("got %d attempts, expected 1", n)
+	}
+
+	// Other errors are not mistaken for an invalid token.
+	other := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"user":"invalid","errors":["user identifier is not a valid user, group, or subscribed user key"],"status":0,"request":"req1"}`)
+		return true
+	})
+	if r := runCommand(t, other, "hi"); r.ExitCode != 1 || strings.Contains(r.Stderr, "check AppToken") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestReceiptFile(t *testing.T) {
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/receipts/rcpt2.json" {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":1,"acknowledged":0,"expired":0,"expires_at":%d,"request":"req1"}`, time.Now().Add(time.Hour).Unix())
+		return true
+	})
+	path := filepath.Join(t.TempDir(), "receipts.jsonl")
+	for _, msg := range []string{"db down", "disk full"} {
+		if r := runCommand(t, srv, "-receipt-file", path, "-priority", "highest", "-title", "alert", msg); r.ExitCode != 0 {
+			t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+		}
+	}
+	// Only highest priority notifications have receipts.
+	if r := runCommand(t, srv, "-receipt-file", path, "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l, err := readReceipts(path)
+	if err != nil || len(l) != 2 {
+		t.Fatalf("got receipts %v, error %v", l, err)
+	}
+	if l[0].Receipt != "rcpt1" || l[0].Request != "req1" || l[0].User != "userkey" || l[0].Title != "alert" || l[0].Message != "db down" || l[0].Time.IsZero() || l[1].Receipt != "rcpt2" {
+		t.Errorf("got receipts %#v", l)
+	}
+
+	r := runCommand(t, srv, "-receipt-file", path, "-check-receipts")
+	if r.ExitCode != 0 || !strings.Contains(r.Stdout, `receipt rcpt1, sent at `) || !strings.Contains(r.Stdout, `title "alert": acknowledged at 2023-11-14T22:13:20Z by userkey (device iphone)`) || !strings.Contains(r.Stdout, "receipt rcpt2,") || !strings.Contains(r.Stdout, ": pending, ") {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+	// Acknowledged receipts are removed.
+	l, err = readReceipts(path)
+	if err != nil || len(l) != 1 || l[0].Receipt != "rcpt2" {
+		t.Errorf("got receipts %v, error %v", l, err)
+	}
+}
+
+func TestMessageFlag(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	if r := runCommand(t, srv, "-message", "-starts with a dash"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "two", "words"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("message") != "-starts with a dash" || l[1].Form.Get("message") != "two words" {
+		t.Errorf("got messages %v", l)
+	}
+	if r := runCommand(t, srv, "-message", "flag", "argument"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine -message with message as arguments") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	line := "login failed for bob token=ghp_abc123XYZ from 10.0.0.1"
+	r := runCommand(t, srv, "-redact", `ghp_[A-Za-z0-9]+`, "-redact", `\b\d+\.\d+\.\d+\.\d+\b`, line)
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("message") != "login failed for bob token=*** from ***" {
+		t.Errorf("got messages %v", l)
+	}
+
+	// Redacting happens before the length check.
+	long := strings.Repeat("secret", 200)
+	if r := runCommand(t, srv, "-redact", "(secret)+", long); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-redact", "(", "hi"); r.ExitCode != 1 || !strings.Contains(r.Stderr, "parsing regular expression for -redact") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestPrefer(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := testConfig + "HTML: true\n"
+	r := runCommandConfig(t, srv, config, "", "-monospace", "hi")
+	if r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine html") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommandConfig(t, srv, config, "", "-monospace", "-prefer", "error", "hi"); r.ExitCode != 2 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommandConfig(t, srv, config, "", "-monospace", "-prefer", "html", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommandConfig(t, srv, config, "", "-monospace", "-prefer", "monospace", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("html") != "1" || l[0].Form.Has("monospace") || l[1].Form.Get("monospace") != "1" || l[1].Form.Has("html") {
+		t.Errorf("got messages %v", l)
+	}
+	if r := runCommandConfig(t, srv, config, "", "-monospace", "-prefer", "both", "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, `invalid value "both" for -prefer`) {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestConfigURL(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	var configBody atomic.Value
+	configBody.Store("AppToken: urltoken\nDestKey: urluser\n")
+	configSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := configBody.Load().(string)
+		if s == "" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, s)
+	}))
+	defer configSrv.Close()
+	// The command trusts the certificate of the config server.
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: configSrv.Certificate().Raw}), 0600); err != nil {
+		t.Fatalf("writing certificate: %v", err)
+	}
+	env := []string{"SSL_CERT_FILE=" + certPath}
+	state := t.TempDir()
+	run := func() cmdResult {
+		t.Helper()
+		return runCommandEnv(t, srv, "", "", env, "-configpath", configSrv.URL+"/pushover.conf", "-state-dir", state, "hi")
+	}
+
+	if r := run(); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// Cached copy is used when fetching fails.
+	configBody.Store("")
+	r := run()
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "warning: fetching config file: ") || !strings.Contains(r.Stderr, "using cached copy") {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("token") != "urltoken" || l[1].Form.Get("user") != "urluser" {
+		t.Errorf("got messages %v", l)
+	}
+
+	configBody.Store("Bogus: field\n")
+	if r := run(); r.ExitCode != 1 || !strings.Contains(r.Stderr, "parsing config file from https://") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestCount(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-count", "héllo wörld ✓")
+	if r.ExitCode != 0 || r.Stdout != "13 characters, 17 bytes, within maximum of 1024 characters\n" {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+	// Over-long messages are reported, not an error.
+	r = runCommand(t, srv, "-count", strings.Repeat("é", 1025))
+	if r.ExitCode != 0 || r.Stdout != "1025 characters, 2050 bytes, exceeds maximum of 1024 characters\n" {
+		t.Errorf("got exit code %d, stdout %q, stderr %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+	if p := srv.paths(); len(p) != 0 {
+		t.Errorf("got requests %v, expected none", p)
+	}
+}
+
+func TestMinPriority(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-min-priority", "normal", "-priority", "low", "debug info")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "not sending, priority -1 is below -min-priority 0") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-min-priority", "normal", "-priority", "high", "disk full"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// Also for the priority from the environment.
+	r = runCommandEnv(t, srv, testConfig, "", []string{"PUSHOVER_PRIORITY=lowest"}, "-min-priority", "normal", "debug info")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "not sending") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("message") != "disk full" {
+		t.Errorf("got messages %v", l)
+	}
+}
+
+func TestMaintenancePage(t *testing.T) {
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "<html><body><h1>Down for maintenance</h1></body></html>")
+		return true
+	})
+	r := runCommand(t, srv, "-retries", "1", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "sending message: pushover appears to be down (HTTP 503)") || strings.Contains(r.Stderr, "<html>") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// Still retried.
+	if n := len(srv.messages()); n != 2 {
+		t.Errorf("got %d attempts, expected 2", n)
+	}
+
+	err := &apiError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable", Header: http.Header{"Content-Type": {"text/html"}}, Body: []byte("<html>")}
+	if s := err.Error(); s != "pushover appears to be down (HTTP 503)" {
+		t.Errorf("got %q", s)
+	}
+	// Not for other content types or statuses.
+	err.Header.Set("Content-Type", "application/json")
+	if s := err.Error(); !strings.Contains(s, `got status "503 Service Unavailable"`) {
+		t.Errorf("got %q", s)
+	}
+	err = &apiError{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{"Content-Type": {"text/html"}}, Body: []byte("<html>")}
+	if s := err.Error(); !strings.Contains(s, `got status "404 Not Found"`) {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	for _, args := range [][]string{{"-exit-code", "2"}, {"-exit-code", "0"}, {"-exit-code", "1", "backup of /home"}, {"-exit-code", "1", "-priority", "highest"}} {
+		if r := runCommand(t, srv, args...); r.ExitCode != 0 {
+			t.Fatalf("%v: got exit code %d, stderr %q", args, r.ExitCode, r.Stderr)
+		}
+	}
+	l := srv.messages()
+	if len(l) != 4 {
+		t.Fatalf("got messages %v", l)
+	}
+	check := func(i int, title, msg, priority string) {
+		t.Helper()
+		f := l[i].Form
+		if f.Get("title") != title || f.Get("message") != msg || f.Get("priority") != priority {
+			t.Errorf("message %d: got title %q, message %q, priority %q, expected %q, %q, %q", i, f.Get("title"), f.Get("message"), f.Get("priority"), title, msg, priority)
+		}
+	}
+	check(0, "Command failed with exit code 2", "Command failed with exit code 2.", "1")
+	check(1, "Command succeeded", "Command succeeded.", "")
+	check(2, "Command failed with exit code 1", "backup of /home", "1")
+	// An explicit priority is kept.
+	check(3, "Command failed with exit code 1", "Command failed with exit code 1.", "2")
+}
+
+func TestMetrics(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	path := filepath.Join(t.TempDir(), "pushover.prom")
+	for range 2 {
+		if r := runCommand(t, srv, "-metrics", path, "hi"); r.ExitCode != 0 {
+			t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+		}
+	}
+	m, err := loadMetrics(path)
+	if err != nil {
+		t.Fatalf("loading metrics: %v", err)
+	}
+	if v := m.values[`pushover_messages_total{result="success"}`]; v != 2 {
+		t.Errorf("got %v successes, expected 2", v)
+	}
+	if v := m.values["pushover_send_duration_seconds_count"]; v != 2 {
+		t.Errorf("got duration count %v, expected 2", v)
+	}
+	if v := m.values["pushover_messages_remaining"]; v != 9000 {
+		t.Errorf("got remaining %v, expected 9000", v)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(buf), "# TYPE pushover_messages_total counter\npushover_messages_total{result=\"success\"} 2\n") {
+		t.Errorf("got metrics file %q, error %v", buf, err)
+	}
+
+	// Failures are counted separately.
+	fail := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return true
+	})
+	if r := runCommand(t, fail, "-metrics", path, "hi"); r.ExitCode != 1 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	m, err = loadMetrics(path)
+	if err != nil || m.values[`pushover_messages_total{result="failure"}`] != 1 || m.values[`pushover_messages_total{result="success"}`] != 2 {
+		t.Errorf("got metrics %v, error %v", m.values, err)
+	}
+}
+
+func TestConfigTitleTooLong(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := testConfig + "Title: " + strings.Repeat("é", 251) + "\n"
+	r := runCommandConfig(t, srv, config, "", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "Title in config file is 251 characters, maximum is 250; shorten it, or use -truncate-title") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommandConfig(t, srv, config, "", "-truncate-title", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// Not an error when the config title is not used.
+	for _, args := range [][]string{{"-title", "short"}, {"-no-title"}} {
+		if r := runCommandConfig(t, srv, config, "", append(args, "hi")...); r.ExitCode != 0 {
+			t.Fatalf("%v: got exit code %d, stderr %q", args, r.ExitCode, r.Stderr)
+		}
+	}
+	l := srv.messages()
+	if len(l) != 3 || l[0].Form.Get("title") != strings.Repeat("é", 249)+"…" || l[1].Form.Get("title") != "short" || l[2].Form.Has("title") {
+		t.Errorf("got messages %v", l)
+	}
+}
+
+func TestContentTypeJSON(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommandConfig(t, srv, testConfig, "GIF89a", "-content-type", "json", "-title", "relay", "-stdin-attachment", "-attachment-type", "image/gif", "hi")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 1 || l[0].ContentType != "application/json" {
+		t.Fatalf("got messages %v", l)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(l[0].Body, &body); err != nil {
+		t.Fatalf("parsing json body %q: %v", l[0].Body, err)
+	}
+	exp := map[string]any{"token": "apptoken", "user": "userkey", "title": "relay", "message": "hi", "attachment_base64": base64.StdEncoding.EncodeToString([]byte("GIF89a")), "attachment_type": "image/gif"}
+	for k, v := range exp {
+		if body[k] != v {
+			t.Errorf("field %s: got %v, expected %v", k, body[k], v)
+		}
+	}
+
+	// Form encoding is the default.
+	if r := runCommand(t, srv, "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 2 || l[1].ContentType != "application/x-www-form-urlencoded" {
+		t.Errorf("got messages %v", l)
+	}
+	if r := runCommand(t, srv, "-content-type", "xml", "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, `unknown -content-type "xml"`) {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestThresholdSound(t *testing.T) {
+	threshold := 1
+	for p, exp := range map[int]string{-2: "quiet", -1: "quiet", 0: "quiet", 1: "loud", 2: "loud"} {
+		if got := thresholdSound(p, threshold, "loud", "quiet"); got != exp {
+			t.Errorf("priority %d: got %q, expected %q", p, got, exp)
+		}
+	}
+	if got := thresholdSound(1, threshold, "", ""); got != "siren" {
+		t.Errorf("got %q, expected default siren", got)
+	}
+	if got := thresholdSound(0, threshold, "", ""); got != "none" {
+		t.Errorf("got %q, expected default none", got)
+	}
+
+	srv := newAPIServer(t, nil)
+	config := testConfig + "LoudSound: custom1\n"
+	for _, p := range []string{"normal", "high", "highest"} {
+		if r := runCommandConfig(t, srv, config, "", "-loud-above", "high", "-priority", p, "hi"); r.ExitCode != 0 {
+			t.Fatalf("priority %s: got exit code %d, stderr %q", p, r.ExitCode, r.Stderr)
+		}
+	}
+	var got []string
+	for _, m := range srv.messages() {
+		got = append(got, m.Form.Get("sound"))
+	}
+	if exp := []string{"none", "custom1", "custom1"}; !slices.Equal(got, exp) {
+		t.Errorf("got sounds %q, expected %q", got, exp)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	// Nothing listens on the api base of runCommand without server.
+	start := time.Now()
+	r := runCommand(t, nil, "-preflight", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "cannot reach 127.0.0.1:1: ") || strings.Contains(r.Stderr, "sending message") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("preflight took %s, expected to fail fast", d)
+	}
+
+	srv := newAPIServer(t, nil)
+	if r := runCommand(t, srv, "-preflight", "hi"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if p := srv.paths(); len(p) != 2 || p[0] != "/" || p[1] != "/messages.json" {
+		t.Errorf("got paths %v", p)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	if r := runCommand(t, srv, "-join", "\n", "line1", "line2"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "line1", "line2"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("message") != "line1\nline2" || l[1].Form.Get("message") != "line1 line2" {
+		t.Errorf("got messages %v", l)
+	}
+}
+
+func TestExec(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	if r := runCommand(t, srv, "-exec", "/bin/sh", "-c", "echo disk usage 91%; echo noise >&2"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("message") != "disk usage 91%" {
+		t.Errorf("got messages %v", l)
+	}
+
+	// Stderr is only included when the command fails.
+	msg, err := execMessage([]string{"/bin/sh", "-c", "echo partial; echo broken >&2; exit 3"})
+	if err != nil || msg != "partial\n\ncommand failed: exit status 3\nstderr:\nbroken" {
+		t.Errorf("got %q, %v", msg, err)
+	}
+	if msg, err := execMessage([]string{"/bin/true"}); err != nil || msg != "(no output)" {
+		t.Errorf("got %q, %v", msg, err)
+	}
+	if _, err := execMessage([]string{"/nonexistent"}); err == nil {
+		t.Errorf("no error for command that cannot be started")
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	fakeAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":1,"request":"req1","new_field":true}`)
+	})
+	defer func() {
+		strictJSON = false
+	}()
+
+	var result messageResult
+	if err := apiPost(context.Background(), "messages.json", url.Values{}, &result); err != nil || result.Request != "req1" {
+		t.Errorf("got %v, %v, expected success without strict json", result, err)
+	}
+	strictJSON = true
+	err := apiPost(context.Background(), "messages.json", url.Values{}, &result)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "new_field"`) {
+		t.Errorf("got error %v, expected unknown field", err)
+	}
+}
+
+func TestTitleTemplate(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	if r := runCommand(t, srv, "-title-template", "backup of {{.host}}", "-var", "host=web1", "done"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("title") != "backup of web1" {
+		t.Errorf("got messages %v", l)
+	}
+	// The length limit applies to the rendered title.
+	r := runCommand(t, srv, "-title-template", "backup of {{.host}}", "-var", "host="+strings.Repeat("x", 241), "done")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "title is 251 characters, maximum is 250") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, "-title-template", "backup of {{.host}}", "-title", "x", "done"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine -title-template with -title or -no-title") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("sent %d messages, expected 1", n)
+	}
+}
+
+func TestVerboseIdentity(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no hostname: %v", err)
+	}
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-verbose", "hi")
+	exp := fmt.Sprintf(" (uid %d) on host %s\n", os.Getuid(), host)
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "sending from user ") || !strings.Contains(r.Stderr, exp) {
+		t.Errorf("got exit code %d, stderr %q, expected %q", r.ExitCode, r.Stderr, exp)
+	}
+	// Not without -verbose.
+	if r := runCommand(t, srv, "hi"); strings.Contains(r.Stderr, "sending from") {
+		t.Errorf("got stderr %q", r.Stderr)
+	}
+}
+
+func TestMaxBodyPreview(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-verbose", "-max-body-preview", "10", strings.Repeat("é", 50))
+	exp := fmt.Sprintf("sent message, request req2: %q\n", strings.Repeat("é", 9)+"…")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, exp) {
+		t.Errorf("got exit code %d, stderr %q, expected %q", r.ExitCode, r.Stderr, exp)
+	}
+	// Short messages are logged as is.
+	r = runCommand(t, srv, "-verbose", "-max-body-preview", "10", "short")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "sent message, request req4: \"short\"\n") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	r = runCommand(t, srv, "-verbose", "-max-body-preview", "0", "short")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "sent message, request req6\n") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestExpiryText(t *testing.T) {
+	orig := location
+	defer func() {
+		location = orig
+	}()
+	location = time.UTC
+
+	now := time.Unix(1700000000, 0)
+	if s := expiryText(1700000000+2*3600+90, now); s != "expires at 2023-11-15T00:14:50Z, in 2h1m30s" {
+		t.Errorf("got %q", s)
+	}
+	if s := expiryText(1700000000-60, now); s != "expires at 2023-11-14T22:12:20Z" {
+		t.Errorf("got %q for expiry in the past", s)
+	}
+	if s := expiryText(0, now); s != "expiry unknown" {
+		t.Errorf("got %q for zero expiry", s)
+	}
+	if ny, err := time.LoadLocation("America/New_York"); err == nil {
+		location = ny
+		if s := expiryText(1700000000+90, now); s != "expires at 2023-11-14T17:14:50-05:00, in 1m30s" {
+			t.Errorf("got %q in america/new_york", s)
+		}
+	}
+}
+
+// attachmentPart returns the attachment in multipart form request r.
+func attachmentPart(t *testing.T, r apiRequest) []byte {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(r.ContentType)
+	if err != nil {
+		t.Fatalf("parsing content-type %q: %v", r.ContentType, err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(r.Body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("no attachment: %v", err)
+		}
+		if p.FormName() == "attachment" {
+			buf, err := io.ReadAll(p)
+			if err != nil {
+				t.Fatalf("reading attachment: %v", err)
+			}
+			return buf
+		}
+	}
+}
+
+func TestAttachmentMultipleRecipients(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	var imgBuf bytes.Buffer
+	if err := pngEncode(&imgBuf); err != nil {
+		t.Fatalf("encoding png: %v", err)
+	}
+	// Stdin can only be read once, each recipient gets the same attachment.
+	r := runCommandConfig(t, srv, testConfig, imgBuf.String(), "-user", "user1", "-user", "user2", "-stdin-attachment", "-attachment-type", "image/png", "graph")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("user") != "user1" || l[1].Form.Get("user") != "user2" {
+		t.Fatalf("got messages %v", l)
+	}
+	for i, m := range l {
+		if buf := attachmentPart(t, m); !bytes.Equal(buf, imgBuf.Bytes()) {
+			t.Errorf("message %d: got attachment of %d bytes, expected %d", i, len(buf), imgBuf.Len())
+		}
+	}
+	// Bodies are assembled for each message.
+	if bytes.Equal(l[0].Body, l[1].Body) {
+		t.Errorf("same request body for both recipients")
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	var slow atomic.Bool
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if !slow.Load() {
+			return false
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		return true
+	})
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	r := runCommand(t, srv, "-deadline", past, "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "deadline "+past+" has passed") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if p := srv.paths(); len(p) != 0 {
+		t.Fatalf("got requests %v, expected none", p)
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	if r := runCommand(t, srv, "-deadline", future, "hi"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+
+	// Api calls are aborted at the deadline.
+	slow.Store(true)
+	start := time.Now()
+	soon := start.Add(2 * time.Second).Format(time.RFC3339)
+	r = runCommand(t, srv, "-deadline", soon, "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "context deadline exceeded") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %s, expected abort at deadline", d)
+	}
+
+	if r := runCommand(t, srv, "-deadline", future, "-timeout", "5s", "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine -deadline and -timeout") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestSoundsCache(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	state := t.TempDir()
+	soundsCalls := func() int {
+		t.Helper()
+		var n int
+		for _, p := range srv.paths() {
+			if p == "/sounds.json" {
+				n++
+			}
+		}
+		return n
+	}
+	for range 2 {
+		if r := runCommand(t, srv, "-state-dir", state, "-sound", "custom1", "hi"); r.ExitCode != 0 {
+			t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+		}
+	}
+	// The second run used the cached list.
+	if n := soundsCalls(); n != 1 {
+		t.Errorf("got %d calls for sounds, expected 1", n)
+	}
+	if r := runCommand(t, srv, "-state-dir", state, "-refresh-sounds", "-sound", "custom1", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := soundsCalls(); n != 2 {
+		t.Errorf("got %d calls for sounds after -refresh-sounds, expected 2", n)
+	}
+	r := runCommand(t, srv, "-state-dir", state, "-sound", "custom2", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, `unknown sound "custom2", available sounds: custom1, pushover, siren`) {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// Built-in sounds do not need the list.
+	if r := runCommand(t, srv, "-state-dir", state, "-sound", "tugboat", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := soundsCalls(); n != 2 {
+		t.Errorf("got %d calls for sounds, expected 2", n)
+	}
+
+	// A stale cached list is used when fetching fails.
+	path := soundsCachePath(state, "apptoken")
+	old := time.Now().Add(-2 * soundsTTL)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	down := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/sounds.json" {
+			return false
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return true
+	})
+	r = runCommand(t, down, "-state-dir", state, "-retries", "0", "-sound", "custom1", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "using cached list") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestNoRecipients(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := "AppToken: apptoken\nDestKey: \n"
+	r := runCommandConfig(t, srv, config, "", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "no recipients, DestKey in config file and -user are empty") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommandConfig(t, srv, config, "", "-allow-empty", "hi"); r.ExitCode != 0 || !strings.Contains(r.Stderr, "no recipients, not sending") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if p := srv.paths(); len(p) != 0 {
+		t.Fatalf("got requests %v, expected none", p)
+	}
+
+	// Groups without members.
+	empty := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasPrefix(r.URL.Path, "/groups/") {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":1,"name":"ops","users":[],"request":"req1"}`)
+		return true
+	})
+	r = runCommand(t, empty, "-user", "gops", "-group-members", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, `group "ops" has no members; use -allow-empty to send anyway`) {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, empty, "-user", "gops", "-group-members", "-allow-empty", "hi"); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(empty.messages()); n != 1 {
+		t.Errorf("sent %d messages, expected 1", n)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	var sentAt atomic.Int64
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		sentAt.Store(time.Now().UnixNano())
+		return false
+	})
+	start := time.Now()
+	if r := runCommand(t, srv, "-delay", "20ms", "-timeout", "5s", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if d := time.Unix(0, sentAt.Load()).Sub(start); d < 20*time.Millisecond {
+		t.Errorf("sent after %s, expected at least 20ms", d)
+	}
+
+	// Interrupting cancels the send.
+	cmd := newCommand(t, srv, testConfig, nil, "-delay", "1m", "-verbose", "later")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatalf("stderr pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting command: %v", err)
+	}
+	br := bufio.NewReader(stderr)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stderr: %v", err)
+		}
+		if strings.Contains(line, "waiting 1m0s before sending") {
+			break
+		}
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+	rest, _ := io.ReadAll(br)
+	cmd.Wait()
+	if code := cmd.ProcessState.ExitCode(); code != 1 || !strings.Contains(string(rest), "interrupted during -delay, not sending") {
+		t.Errorf("got exit code %d, stderr %q", code, rest)
+	}
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("sent %d messages, expected 1", n)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	r := runCommand(t, nil, "-features")
+	var f struct {
+		APIVersion string   `json:"api_version"`
+		Features   []string `json:"features"`
+		Flags      []string `json:"flags"`
+	}
+	if err := json.Unmarshal([]byte(r.Stdout), &f); r.ExitCode != 0 || err != nil {
+		t.Fatalf("got exit code %d, error %v, stdout %q", r.ExitCode, err, r.Stdout)
+	}
+	if f.APIVersion != "1" {
+		t.Errorf("got api version %q", f.APIVersion)
+	}
+	for _, s := range []string{"attachment", "emergency", "tags", "listen"} {
+		if !slices.Contains(f.Features, s) {
+			t.Errorf("missing feature %q in %v", s, f.Features)
+		}
+	}
+	// Glances are not implemented.
+	if slices.Contains(f.Features, "glances") {
+		t.Errorf("unexpected feature glances")
+	}
+	for _, s := range []string{"priority", "stdin-attachment", "features"} {
+		if !slices.Contains(f.Flags, s) {
+			t.Errorf("missing flag %q in %v", s, f.Flags)
+		}
+	}
+}
+
+func TestConfigRetryExpire(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := testConfig + "Retry: 60\nExpire: 7200\n"
+	if r := runCommandConfig(t, srv, config, "", "-priority", "highest", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	// Flags override the config.
+	if r := runCommandConfig(t, srv, config, "", "-priority", "highest", "-retry", "120", "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 2 || l[0].Form.Get("retry") != "60" || l[0].Form.Get("expire") != "7200" || l[1].Form.Get("retry") != "120" || l[1].Form.Get("expire") != "7200" {
+		t.Errorf("got messages %v", l)
+	}
+
+	if r := runCommandConfig(t, srv, testConfig+"Retry: 10\n", "", "hi"); r.ExitCode != 1 || !strings.Contains(r.Stderr, "Retry in config file is 10, must be at least 30") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommandConfig(t, srv, testConfig+"Expire: 20000\n", "", "hi"); r.ExitCode != 1 || !strings.Contains(r.Stderr, "Expire in config file is 20000, must be between 1 and 10800") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Form.Get("message") != "fail" {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":0,"errors":["rejected"],"request":"req1"}`)
+		return true
+	})
+	r := runCommandConfig(t, srv, testConfig, "ok1\nfail\nok1\nok2\n", "-batch-stdin", "-interval", "0", "-dedup", "-summary", "-json")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "sent: 2, failed: 1, skipped: 1\n") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	var out struct {
+		Results []sendResult `json:"results"`
+		Summary sendSummary  `json:"summary"`
+	}
+	if err := json.Unmarshal([]byte(r.Stdout), &out); err != nil {
+		t.Fatalf("parsing output %q: %v", r.Stdout, err)
+	}
+	if len(out.Results) != 3 || out.Results[1].Error == "" || out.Summary != (sendSummary{2, 1, 1}) {
+		t.Errorf("got output %+v", out)
+	}
+}
+
+func TestPrefixTimestamp(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	layout := "2006-01-02 15:04:05 MST"
+	start := time.Now().Truncate(time.Second)
+	if r := runCommand(t, srv, "-prefix-timestamp", layout, "backup done"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 1 {
+		t.Fatalf("got messages %v", l)
+	}
+	msg := l[0].Form.Get("message")
+	ts, rest, _ := strings.Cut(msg, " UTC ")
+	tm, err := time.ParseInLocation("2006-01-02 15:04:05", ts, time.UTC)
+	if err != nil || rest != "backup done" || tm.Before(start) || tm.After(time.Now()) {
+		t.Errorf("got message %q, parse error %v", msg, err)
+	}
+
+	// The timestamp counts towards the maximum length.
+	r := runCommand(t, srv, "-prefix-timestamp", "2006-01-02", strings.Repeat("x", 1020))
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "message is 1031 characters, maximum is 1024") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestConfigFlagOverrides(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := testConfig + "HTML: true\nLoudSound: custom1\nQuietSound: pushover\n"
+	run := func(args ...string) apiRequest {
+		t.Helper()
+		r := runCommandConfig(t, srv, config, "", append(args, "hi")...)
+		if r.ExitCode != 0 {
+			t.Fatalf("%v: got exit code %d, stderr %q", args, r.ExitCode, r.Stderr)
+		}
+		l := srv.messages()
+		return l[len(l)-1]
+	}
+
+	// Unspecified flags leave config values intact, even though their defaults
+	// differ.
+	m := run("-loud-above", "high", "-priority", "high")
+	if m.Form.Get("token") != "apptoken" || m.Form.Get("html") != "1" || m.Form.Get("sound") != "custom1" {
+		t.Errorf("got form %v", m.Form)
+	}
+	m = run("-loud-above", "high")
+	if m.Form.Get("sound") != "pushover" {
+		t.Errorf("got form %v", m.Form)
+	}
+
+	m = run("-app-token", "flagtoken", "-html=false", "-loud-above", "high", "-priority", "high", "-loud-sound", "siren")
+	if m.Form.Get("token") != "flagtoken" || m.Form.Has("html") || m.Form.Get("sound") != "siren" {
+		t.Errorf("got form %v", m.Form)
+	}
+	m = run("-loud-above", "high", "-quiet-sound", "none")
+	if m.Form.Get("sound") != "none" {
+		t.Errorf("got form %v", m.Form)
+	}
+}
+
+func TestValidateDescribe(t *testing.T) {
+	tests := []struct {
+		result validateResult
+		exp    string
+	}{
+		{validateResult{Group: 1}, "this appears to be a group key"},
+		{validateResult{Devices: []string{"iphone"}}, "this is a user key with 1 device"},
+		{validateResult{Devices: []string{"iphone", "pixel"}}, "this is a user key with 2 devices"},
+		{validateResult{}, "this is a user key without active devices"},
+	}
+	for _, tc := range tests {
+		if s := tc.result.describe(); s != tc.exp {
+			t.Errorf("%+v: got %q, expected %q", tc.result, s, tc.exp)
+		}
+	}
+
+	// Against fake validate responses, group keys start with "g".
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-verbose", "-user", "userkey", "-user", "gopskey", "hi")
+	if r.ExitCode != 0 || !strings.Contains(r.Stderr, "sending to userkey, this is a user key with 2 devices\n") || !strings.Contains(r.Stderr, "sending to gopskey, this appears to be a group key\n") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestConfigDevice(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	config := testConfig + "Device: iphone\n"
+	for _, args := range [][]string{nil, {"-device", "pixel"}, {"-user", "otheruser"}} {
+		if r := runCommandConfig(t, srv, config, "", append(args, "hi")...); r.ExitCode != 0 {
+			t.Fatalf("%v: got exit code %d, stderr %q", args, r.ExitCode, r.Stderr)
+		}
+	}
+	var got []string
+	for _, m := range srv.messages() {
+		got = append(got, m.Form.Get("device"))
+	}
+	// The config device is for DestKey, not for other users.
+	if exp := []string{"iphone", "pixel", ""}; !slices.Equal(got, exp) {
+		t.Errorf("got devices %q, expected %q", got, exp)
+	}
+	if r := runCommandConfig(t, srv, testConfig+"Device:  \n", "", "hi"); r.ExitCode != 1 || !strings.Contains(r.Stderr, "Device in config file is empty") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestRetryLog(t *testing.T) {
+	var attempts atomic.Int32
+	srv := newAPIServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if attempts.Add(1) > 2 {
+			return false
+		}
+		http.Error(w, "temporary failure", http.StatusServiceUnavailable)
+		return true
+	})
+	path := filepath.Join(t.TempDir(), "retries.log")
+	if r := runCommand(t, srv, "-retries", "2", "-retry-log", path, "hi"); r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading retry log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got retry log %q, expected 3 lines", buf)
+	}
+	for i, s := range []string{" attempt=1 result=error status=503 error=", " attempt=2 result=error status=503 error=", " attempt=3 result=ok request=req3"} {
+		if !strings.Contains(lines[i], s) {
+			t.Errorf("line %d: got %q, expected %q", i, lines[i], s)
+		}
+	}
+	if !strings.HasSuffix(lines[0], " backoff=1s") || !strings.HasSuffix(lines[1], " backoff=2s") || strings.Contains(lines[2], "backoff") {
+		t.Errorf("got backoffs in %q", lines)
+	}
+}
+
+func TestConfirmAbove(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	users := []string{"-user", "u1", "-user", "u2", "-user", "u3"}
+	// Stdin of the command is not a terminal.
+	r := runCommandConfig(t, srv, testConfig, "y\n", append(append([]string{"-confirm-above", "2"}, users...), "hi")...)
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "not sending to 3 recipients, above -confirm-above 2: cannot ask for confirmation, stdin is not a terminal") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 0 {
+		t.Fatalf("sent %d messages, expected none", n)
+	}
+
+	if r := runCommand(t, srv, append(append([]string{"-confirm-above", "2", "-force"}, users...), "hi")...); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if r := runCommand(t, srv, append(append([]string{"-confirm-above", "3"}, users...), "hi")...); r.ExitCode != 0 {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if n := len(srv.messages()); n != 6 {
+		t.Errorf("sent %d messages, expected 6", n)
+	}
+}
+
+func TestHighestAllParameters(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-priority", "highest", "-retry", "30", "-expire", "10800", "-callback", "https://example.com/ack", "-tags", "db,disk", "hi")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 1 {
+		t.Fatalf("got messages %v", l)
+	}
+	exp := map[string]string{"priority": "2", "retry": "30", "expire": "10800", "callback": "https://example.com/ack", "tags": "db,disk"}
+	for k, v := range exp {
+		if got := l[0].Form.Get(k); got != v {
+			t.Errorf("field %s: got %q, expected %q", k, got, v)
+		}
+	}
+	if err := validateMessage(l[0].Form); err != nil {
+		t.Errorf("validating sent form: %v", err)
+	}
+
+	r = runCommand(t, srv, "-priority", "highest", "-retry", "30", "-expire", "10800", "-callback", "http://example.com/ack", "hi")
+	if r.ExitCode != 1 || !strings.Contains(r.Stderr, "callback must be an https url") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestField(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-title", "t", "-field", "newparam=x=y", "-field", "title=other", "-field", "user=other", "hi")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if !strings.Contains(r.Stderr, "warning: ignoring -field title") || !strings.Contains(r.Stderr, "warning: ignoring -field user") {
+		t.Errorf("missing warnings, stderr %q", r.Stderr)
+	}
+	l := srv.messages()
+	if len(l) != 1 {
+		t.Fatalf("got messages %v", l)
+	}
+	if f := l[0].Form; f.Get("newparam") != "x=y" || f.Get("title") != "t" || f.Get("user") == "other" {
+		t.Errorf("got form %v", f)
+	}
+
+	for _, kv := range []string{"novalue", "=x"} {
+		if r := runCommand(t, srv, "-field", kv, "hi"); r.ExitCode != 2 || !strings.Contains(r.Stderr, "invalid -field") {
+			t.Errorf("-field %q: got exit code %d, stderr %q", kv, r.ExitCode, r.Stderr)
+		}
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	id := func(args ...string) string {
+		t.Helper()
+		r := runCommand(t, srv, append([]string{"-json"}, args...)...)
+		if r.ExitCode != 0 {
+			t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+		}
+		var results []sendResult
+		if err := json.Unmarshal([]byte(r.Stdout), &results); err != nil || len(results) != 1 {
+			t.Fatalf("parsing json output %q: %v", r.Stdout, err)
+		}
+		l := srv.messages()
+		if form := l[len(l)-1].Form.Get("correlation_id"); form != results[0].CorrelationID {
+			t.Errorf("form correlation id %q, json %q", form, results[0].CorrelationID)
+		}
+		return results[0].CorrelationID
+	}
+
+	if a, b := id("-correlation-id", "deploy-1", "hi"), id("-correlation-id", "deploy-1", "hi"); a != "deploy-1" || b != "deploy-1" {
+		t.Errorf("got correlation ids %q and %q, expected deploy-1", a, b)
+	}
+	if a, b := id("-correlation-id", "auto", "hi"), id("-correlation-id", "auto", "hi"); a == "" || a == "auto" || a == b {
+		t.Errorf("got auto correlation ids %q and %q, expected different random ids", a, b)
+	}
+	if c := id("hi"); c != "" {
+		t.Errorf("got correlation id %q without -correlation-id", c)
+	}
+}
+
+func TestDashMessage(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	r := runCommand(t, srv, "-title", "weather", "--", "-5", "degrees", "outside")
+	if r.ExitCode != 0 {
+		t.Fatalf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if l := srv.messages(); len(l) != 1 || l[0].Form.Get("message") != "-5 degrees outside" || l[0].Form.Get("title") != "weather" {
+		t.Errorf("got messages %v", l)
+	}
+	if r := runCommand(t, srv, "-5", "degrees"); r.ExitCode != 2 {
+		t.Errorf("without --, got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+}
+
+func TestAttachmentModes(t *testing.T) {
+	srv := newAPIServer(t, nil)
+	for _, args := range [][]string{
+		{"-count"},
+		{"-healthcheck"},
+		{"-cancel-by-tag", "db"},
+	} {
+		args = append([]string{"-stdin-attachment", "-attachment-type", "image/png"}, args...)
+		r := runCommand(t, srv, args...)
+		if r.ExitCode != 2 || !strings.Contains(r.Stderr, "cannot combine -stdin-attachment and "+args[3]) {
+			t.Errorf("%v: got exit code %d, stderr %q", args, r.ExitCode, r.Stderr)
+		}
+	}
+	r := runCommand(t, srv, "-attachment-type", "image/png", "hi")
+	if r.ExitCode != 2 || !strings.Contains(r.Stderr, "require -stdin-attachment") {
+		t.Errorf("got exit code %d, stderr %q", r.ExitCode, r.Stderr)
+	}
+	if p := srv.paths(); len(p) != 0 {
+		t.Errorf("got api calls %v", p)
+	}
+}
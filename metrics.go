@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsFile holds counters about sent messages, persisted in the Prometheus
+// text format, e.g. for the textfile collector of node_exporter. Counters are
+// accumulated over invocations.
+type metricsFile struct {
+	path   string
+	values map[string]float64 // Keyed by metric name with labels.
+}
+
+// metricTypes describes the metrics we write.
+var metricTypes = map[string]string{
+	"pushover_messages_total":                 "counter",
+	"pushover_send_duration_seconds_sum":      "counter",
+	"pushover_send_duration_seconds_count":    "counter",
+	"pushover_messages_remaining":             "gauge",
+	"pushover_last_send_timestamp_seconds":    "gauge",
+	"pushover_last_success_timestamp_seconds": "gauge",
+}
+
+// loadMetrics reads the metrics from path. A missing file results in empty
+// metrics.
+func loadMetrics(path string) (*metricsFile, error) {
+	m := &metricsFile{path, map[string]float64{}}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("bad line %q", line)
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad value in line %q", line)
+		}
+		m.values[line[:i]] = v
+	}
+	return m, nil
+}
+
+// record adds the outcome of an attempt to send a message, and saves the
+// metrics. Remaining is the message quota left, or -1 if unknown.
+func (m *metricsFile) record(t time.Time, ok bool, d time.Duration, remaining int) error {
+	result := "failure"
+	if ok {
+		result = "success"
+		m.values["pushover_last_success_timestamp_seconds"] = float64(t.Unix())
+	}
+	m.values[`pushover_messages_total{result="`+result+`"}`]++
+	m.values["pushover_send_duration_seconds_sum"] += d.Seconds()
+	m.values["pushover_send_duration_seconds_count"]++
+	m.values["pushover_last_send_timestamp_seconds"] = float64(t.Unix())
+	if remaining >= 0 {
+		m.values["pushover_messages_remaining"] = float64(remaining)
+	}
+
+	var b strings.Builder
+	var prev string
+	for _, k := range slices.Sorted(maps.Keys(m.values)) {
+		name, _, _ := strings.Cut(k, "{")
+		if name != prev {
+			if typ, ok := metricTypes[name]; ok {
+				fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+			}
+			prev = name
+		}
+		fmt.Fprintf(&b, "%s %s\n", k, strconv.FormatFloat(m.values[k], 'g', -1, 64))
+	}
+	// Readable by others, for collectors running as another user.
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
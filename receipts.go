@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+)
+
+// pendingReceipt is a receipt of a highest priority message, stored in the
+// receipt file as a line of json.
+type pendingReceipt struct {
+	Receipt string    `json:"receipt"`
+	Request string    `json:"request"`
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Title   string    `json:"title,omitempty"`
+	Message string    `json:"message"`
+}
+
+// receiptResult is the response to fetching a receipt.
+type receiptResult struct {
+	Status               int    `json:"status"`
+	Acknowledged         int    `json:"acknowledged"`
+	AcknowledgedAt       int64  `json:"acknowledged_at"`
+	AcknowledgedBy       string `json:"acknowledged_by"`
+	AcknowledgedByDevice string `json:"acknowledged_by_device"`
+	LastDeliveredAt      int64  `json:"last_delivered_at"`
+	Expired              int    `json:"expired"`
+	ExpiresAt            int64  `json:"expires_at"`
+	CalledBack           int    `json:"called_back"`
+	CalledBackAt         int64  `json:"called_back_at"`
+	Request              string `json:"request"`
+}
+
+// appendReceipt adds r to the receipt file at path.
+func appendReceipt(path string, r pendingReceipt) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readReceipts reads the receipts from the receipt file at path. A missing
+// file has no receipts.
+func readReceipts(path string) ([]pendingReceipt, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var l []pendingReceipt
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var r pendingReceipt
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("parsing receipt line: %w", err)
+		}
+		l = append(l, r)
+	}
+	return l, scanner.Err()
+}
+
+// writeReceipts replaces the receipt file at path with receipts, atomically.
+func writeReceipts(path string, receipts []pendingReceipt) error {
+	var b bytes.Buffer
+	for _, r := range receipts {
+		buf, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		b.Write(append(buf, '\n'))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// fetchReceipt fetches the status of a receipt.
+func fetchReceipt(ctx context.Context, token, receipt string) (receiptResult, error) {
+	var result receiptResult
+	err := apiGet(ctx, "receipts/"+url.PathEscape(receipt)+".json", url.Values{"token": {token}}, &result)
+	return result, err
+}
+
+// checkReceipts fetches the status of each receipt in the receipt file at path,
+// printing a line per receipt. Receipts that are acknowledged or expired are
+// removed from the file. It returns whether all receipts could be checked.
+func checkReceipts(ctx context.Context, token, path string) (bool, error) {
+	receipts, err := readReceipts(path)
+	if err != nil {
+		return false, err
+	}
+	ok := true
+	var pending []pendingReceipt
+	for _, r := range receipts {
+		desc := fmt.Sprintf("receipt %s, sent at %s, title %q", r.Receipt, formatTime(r.Time), r.Title)
+		result, err := fetchReceipt(ctx, token, r.Receipt)
+		switch {
+		case err != nil:
+			fmt.Printf("%s: error: %s\n", desc, err)
+			ok = false
+			pending = append(pending, r)
+		case result.Acknowledged == 1:
+			fmt.Printf("%s: acknowledged at %s by %s (device %s)\n", desc, formatTime(time.Unix(result.AcknowledgedAt, 0)), result.AcknowledgedBy, result.AcknowledgedByDevice)
+		case result.Expired == 1:
+			fmt.Printf("%s: expired at %s, not acknowledged\n", desc, formatTime(time.Unix(result.ExpiresAt, 0)))
+		default:
+			fmt.Printf("%s: pending, %s\n", desc, expiryText(result.ExpiresAt, time.Now()))
+			pending = append(pending, r)
+		}
+	}
+	if len(pending) != len(receipts) {
+		if err := writeReceipts(path, pending); err != nil {
+			return false, fmt.Errorf("writing receipt file: %w", err)
+		}
+	}
+	return ok, nil
+}
+
+// expiryText describes when retries of a highest priority notification with
+// expiresAt, as unix time, stop, relative to now. Zero is unknown.
+func expiryText(expiresAt int64, now time.Time) string {
+	if expiresAt == 0 {
+		return "expiry unknown"
+	}
+	t := time.Unix(expiresAt, 0)
+	d := t.Sub(now).Truncate(time.Second)
+	if d <= 0 {
+		return fmt.Sprintf("expires at %s", formatTime(t))
+	}
+	return fmt.Sprintf("expires at %s, in %s", formatTime(t), d)
+}
+
+// minAckInterval is the minimum interval between polls of a receipt, pushover
+// asks to not poll more often than every 5 seconds.
+const minAckInterval = 5 * time.Second
+
+// waitReceipts polls the receipts every interval until each is acknowledged
+// or expired, printing a line per receipt to out once its outcome is known.
+// Each api call gets timeout. An error is returned if a receipt could not be
+// fetched or expired without acknowledgement.
+func waitReceipts(ctx context.Context, token string, receipts []string, interval, timeout time.Duration, out io.Writer) error {
+	pending := slices.Clone(receipts)
+	var expired int
+	for {
+		var next []string
+		for _, r := range pending {
+			fctx, cancel := context.WithTimeout(ctx, timeout)
+			result, err := fetchReceipt(fctx, token, r)
+			cancel()
+			switch {
+			case err != nil:
+				return fmt.Errorf("fetching receipt %s: %w", r, err)
+			case result.Acknowledged == 1:
+				fmt.Fprintf(out, "receipt %s: acknowledged at %s by %s (device %s)\n", r, formatTime(time.Unix(result.AcknowledgedAt, 0)), result.AcknowledgedBy, result.AcknowledgedByDevice)
+			case result.Expired == 1:
+				fmt.Fprintf(out, "receipt %s: expired at %s, not acknowledged\n", r, formatTime(time.Unix(result.ExpiresAt, 0)))
+				expired++
+			default:
+				log.Printf("receipt %s: not yet acknowledged, %s", r, expiryText(result.ExpiresAt, time.Now()))
+				next = append(next, r)
+			}
+		}
+		pending = next
+		if len(pending) == 0 {
+			break
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+	if expired > 0 {
+		return fmt.Errorf("%d notification(s) expired without acknowledgement", expired)
+	}
+	return nil
+}
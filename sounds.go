@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// builtinSounds are the sounds pushover provides to all applications. Sounds
+// uploaded for an application are only known through the api.
+var builtinSounds = []string{
+	"pushover", "bike", "bugle", "cashregister", "classical", "cosmic", "falling",
+	"gamelan", "incoming", "intermission", "magic", "mechanical", "pianobar",
+	"siren", "spacealarm", "tugboat", "alien", "climb", "persistent", "echo",
+	"updown", "vibrate", "none",
+}
+
+// soundsTTL is how long a fetched list of sounds is used before fetching again.
+const soundsTTL = 24 * time.Hour
+
+// soundsResult is the response to fetching the sounds of an application.
+type soundsResult struct {
+	Status  int               `json:"status"`
+	Sounds  map[string]string `json:"sounds"` // Name to description.
+	Request string            `json:"request"`
+}
+
+// soundsCachePath returns the path for the cached list of sounds of the
+// application with token, in stateDir.
+func soundsCachePath(stateDir, token string) string {
+	h := sha256.Sum256([]byte(token))
+	return filepath.Join(stateDir, "sounds-"+hex.EncodeToString(h[:8])+".json")
+}
+
+// fetchSounds returns the sounds available to the application, from the cache
+// file at path if fetched within soundsTTL and refresh is not set, or from the
+// api, updating the cache. If fetching fails, a stale cached list is used. An
+// empty path disables the cache.
+func fetchSounds(ctx context.Context, token, path string, refresh bool) (map[string]string, error) {
+	var cached map[string]string
+	if path != "" {
+		if buf, err := os.ReadFile(path); err == nil {
+			if err := json.Unmarshal(buf, &cached); err != nil {
+				log.Printf("warning: parsing cached sounds from %s: %s", path, err)
+				cached = nil
+			} else if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) < soundsTTL && !refresh {
+				return cached, nil
+			}
+		}
+	}
+
+	var result soundsResult
+	if err := apiGet(ctx, "sounds.json", url.Values{"token": {token}}, &result); err != nil {
+		if cached != nil {
+			log.Printf("warning: fetching sounds: %s, using cached list", err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	if path != "" {
+		buf, err := json.Marshal(result.Sounds)
+		if err == nil {
+			err = writeFile(path, buf)
+		}
+		if err != nil {
+			log.Printf("warning: caching sounds: %s", err)
+		}
+	}
+	return result.Sounds, nil
+}
+
+// checkSound returns whether sound is available to the application. Built-in
+// sounds are known without api call, unless refresh is set.
+func checkSound(ctx context.Context, token, path, sound string, refresh bool) (bool, map[string]string, error) {
+	if !refresh && slices.Contains(builtinSounds, sound) {
+		return true, nil, nil
+	}
+	sounds, err := fetchSounds(ctx, token, path, refresh)
+	if err != nil {
+		return false, nil, err
+	}
+	_, ok := sounds[sound]
+	return ok, sounds, nil
+}